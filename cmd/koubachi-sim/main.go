@@ -0,0 +1,269 @@
+// koubachi-sim acts like one or many koubachi sensors to exercise the server
+// without real hardware. Every cycle it connects, fetches the configuration
+// if it changed and posts synthetic readings for all known sensor codes,
+// checking the encrypted responses of the server.
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"koubachi-goserver/pkg/crypto"
+	"koubachi-goserver/pkg/sensors"
+)
+
+type simulator struct {
+	server   string
+	key      []byte
+	interval time.Duration
+	cycles   int
+	readings int
+	client   *http.Client
+	failures int64
+}
+
+type device struct {
+	macAddress       string
+	skew             time.Duration
+	lastConfigChange int64
+}
+
+func main() {
+	server := flag.String("server", "http://localhost:8005", "address of the server")
+	mac := flag.String("mac", "001122334455", "mac address of the first device, further devices count up")
+	key := flag.String("key", "00112233445566778899aabbccddeeff", "hex encoded key shared by all devices")
+	devices := flag.Int("devices", 1, "number of simulated devices")
+	interval := flag.Duration("interval", 10*time.Second, "time between two transmits of a device")
+	cycles := flag.Int("cycles", 1, "transmits per device, 0 runs forever")
+	readings := flag.Int("readings", 1, "readings per sensor code and transmit")
+	skew := flag.Duration("skew", 0, "maximum clock skew of a device, each device gets a random skew within +/- skew")
+	timeout := flag.Duration("timeout", 10*time.Second, "timeout of a single request")
+	flag.Parse()
+
+	k, err := hex.DecodeString(*key)
+	if err != nil {
+		log.Fatalf("error: invalid key: %v", err)
+	}
+	first, err := strconv.ParseUint(*mac, 16, 48)
+	if err != nil {
+		log.Fatalf("error: invalid mac address: %v", err)
+	}
+
+	sim := &simulator{
+		server:   strings.TrimRight(*server, "/"),
+		key:      k,
+		interval: *interval,
+		cycles:   *cycles,
+		readings: *readings,
+		client:   &http.Client{Timeout: *timeout},
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < *devices; i++ {
+		d := &device{
+			macAddress: fmt.Sprintf("%012x", first+uint64(i)),
+		}
+		if *skew > 0 {
+			d.skew = time.Duration(rand.Int63n(int64(2**skew))) - *skew
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sim.run(d)
+		}()
+	}
+	wg.Wait()
+
+	if sim.failures > 0 {
+		log.Printf("%d checks failed", sim.failures)
+		os.Exit(1)
+	}
+}
+
+func (sim *simulator) run(d *device) {
+	// spread the devices over the interval
+	time.Sleep(time.Duration(rand.Int63n(int64(sim.interval)/10 + 1)))
+
+	for cycle := 0; sim.cycles == 0 || cycle < sim.cycles; cycle++ {
+		if cycle > 0 {
+			time.Sleep(sim.interval)
+		}
+		if err := sim.transmit(d); err != nil {
+			atomic.AddInt64(&sim.failures, 1)
+			log.Printf("%s: %v", d.macAddress, err)
+			continue
+		}
+		log.Printf("%s: transmit %d ok", d.macAddress, cycle+1)
+	}
+}
+
+// transmit runs the request sequence of a real device.
+func (sim *simulator) transmit(d *device) error {
+	announcement := "firmware_version=sim-1.0&hardware_product_type=koubachi-sim&mac_address=" + d.macAddress
+	response, err := sim.request(d, http.MethodPut, "", http.StatusOK, []byte(announcement))
+	if err != nil {
+		return fmt.Errorf("connect: %v", err)
+	}
+	lastConfigChange, err := checkTimes(response)
+	if err != nil {
+		return fmt.Errorf("connect: %v", err)
+	}
+
+	if lastConfigChange > d.lastConfigChange {
+		response, err := sim.request(d, http.MethodPost, "/config", http.StatusOK, []byte("config_version=0"))
+		if err != nil {
+			return fmt.Errorf("config: %v", err)
+		}
+		if err := checkConfig(response); err != nil {
+			return fmt.Errorf("config: %v", err)
+		}
+		d.lastConfigChange = lastConfigChange
+	}
+
+	body, err := json.Marshal(sim.syntheticData(d))
+	if err != nil {
+		return err
+	}
+	response, err = sim.request(d, http.MethodPost, "/readings", http.StatusCreated, body)
+	if err != nil {
+		return fmt.Errorf("readings: %v", err)
+	}
+	if _, err := checkTimes(response); err != nil {
+		return fmt.Errorf("readings: %v", err)
+	}
+	return nil
+}
+
+// request sends an encrypted request and returns the decrypted response.
+func (sim *simulator) request(d *device, method, path string, status int, body []byte) (url.Values, error) {
+	encrypted, err := crypto.Encrypt(sim.key, body)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest(method, sim.server+"/v1/smart_devices/"+d.macAddress+path, bytes.NewReader(encrypted))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-koubachi-aes-encrypted")
+
+	res, err := sim.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != status {
+		return nil, fmt.Errorf("received status %d, expected %d", res.StatusCode, status)
+	}
+
+	data, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := crypto.Decrypt(sim.key, data)
+	if err != nil {
+		return nil, fmt.Errorf("decrypting response: %v", err)
+	}
+	return url.ParseQuery(string(plaintext))
+}
+
+// syntheticData creates readings for every known sensor code, timestamps are
+// taken from the skewed clock of the device.
+func (sim *simulator) syntheticData(d *device) interface{} {
+	now := time.Now().Add(d.skew).Unix()
+
+	codes := make([]int, 0)
+	for code := range sensors.GetSensors() {
+		codes = append(codes, code)
+	}
+	sort.Ints(codes)
+
+	readings := make([][]interface{}, 0, len(codes)*sim.readings)
+	for i := sim.readings - 1; i >= 0; i-- {
+		timestamp := now - int64(i)*int64(sim.interval/time.Second)
+		for _, code := range codes {
+			readings = append(readings, []interface{}{timestamp, code, rawValue(code)})
+		}
+	}
+
+	return map[string]interface{}{
+		"timestamp": now,
+		"readings":  readings,
+	}
+}
+
+// rawValue returns a plausible raw value of a sensor code.
+func rawValue(code int) float64 {
+	between := func(min, max float64) float64 {
+		return min + rand.Float64()*(max-min)
+	}
+
+	switch code {
+	case 2:
+		return between(2.6, 3.2)
+	case 6:
+		return float64(rand.Intn(3000) + 200)
+	case 7:
+		return between(0.45, 0.6)
+	case 8:
+		return between(0, 0.005)
+	case 9:
+		return float64(-rand.Intn(50) - 30)
+	case 10:
+		return 1
+	case 11:
+		return between(15, 28)
+	case 12:
+		return between(3600, 8700)
+	case 15:
+		return between(23000, 28000)
+	case 29:
+		return float64(rand.Intn(0x1000)<<17 | rand.Intn(0x800)<<1 | 1<<16 | 1)
+	}
+	if code >= 8192 {
+		return float64(rand.Intn(2))
+	}
+	return float64(rand.Intn(100))
+}
+
+func checkTimes(response url.Values) (int64, error) {
+	if _, err := strconv.ParseInt(response.Get("current_time"), 10, 64); err != nil {
+		return 0, fmt.Errorf("invalid current_time: %v", err)
+	}
+	lastConfigChange, err := strconv.ParseInt(response.Get("last_config_change"), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid last_config_change: %v", err)
+	}
+	return lastConfigChange, nil
+}
+
+func checkConfig(response url.Values) error {
+	for _, key := range []string{"current_time", "transmit_interval", "transmit_app_led", "sensor_app_led", "day_threshold"} {
+		if response.Get(key) == "" {
+			return fmt.Errorf("missing %s", key)
+		}
+	}
+	for code := range sensors.GetSensors() {
+		if response.Get(fmt.Sprintf("sensor_enabled[%d]", code)) == "" {
+			return fmt.Errorf("missing sensor_enabled[%d]", code)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"koubachi-goserver/pkg/api"
+	"koubachi-goserver/pkg/config"
+	"koubachi-goserver/pkg/model"
+)
+
+const testMacAddress = "001122334455"
+const testKey = "00112233445566778899aabbccddeeff"
+
+func TestSimulator(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	configured := config.Device{
+		Name: "pot",
+		Key:  testKey,
+		CalibrationParameters: config.CalibrationParameters{
+			SmuGain:            1.0,
+			MoistureContinuity: 8778.25,
+			MoistureMin:        3515.25,
+		},
+	}
+	a := api.New(&config.Config{
+		Output:  config.Output{Backend: "memory"},
+		Devices: map[string]config.Device{testMacAddress: configured},
+	})
+	defer a.Store.Close()
+	router := gin.New()
+	a.AttachRoutes(router.Group("/"))
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	k, _ := hex.DecodeString(testKey)
+	sim := &simulator{
+		server:   server.URL,
+		key:      k,
+		interval: 10 * time.Millisecond,
+		cycles:   2,
+		readings: 2,
+		client:   &http.Client{Timeout: 10 * time.Second},
+	}
+	sim.run(&device{macAddress: testMacAddress})
+	if sim.failures != 0 {
+		t.Fatalf("received %d failed checks, expected none", sim.failures)
+	}
+
+	// the server decrypted the announcement and the readings of the simulator
+	stored := a.Store.GetDevice(testMacAddress)
+	if stored == nil || stored.LastSeen == 0 {
+		t.Fatalf("received device %+v, expected it seen", stored)
+	}
+	if info := a.Store.GetDeviceInfo(stored.Id); len(info) == 0 || info[len(info)-1].HardwareProductType != "koubachi-sim" {
+		t.Errorf("received device info %+v, expected the announcement of the simulator", info)
+	}
+	latest := map[string]float64{}
+	for _, reading := range a.Store.GetLatestReadings(stored.Id) {
+		latest[reading.Sensor] = reading.ConvertedValue
+	}
+	for _, sensor := range []string{model.SoilMoisture, model.SoilTemperature, model.Temperature, model.Light, model.BatteryVoltage} {
+		if _, found := latest[sensor]; !found {
+			t.Errorf("received latest readings %v, expected %s", latest, sensor)
+		}
+	}
+	// raw soil temperatures of 15 to 28 are converted
+	if value := latest[model.SoilTemperature]; value < 12.5 || value > 25.5 {
+		t.Errorf("received soil temperature %g, expected 12.5 to 25.5", value)
+	}
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"io/ioutil"
+	"log"
+	"time"
+
+	"koubachi-goserver/pkg/api"
+	"koubachi-goserver/pkg/config"
+	migration "koubachi-goserver/pkg/migrate"
+	"koubachi-goserver/pkg/model"
+	"koubachi-goserver/pkg/postgres"
+	"koubachi-goserver/pkg/sqlite"
+	"koubachi-goserver/pkg/storage"
+
+	"gopkg.in/yaml.v2"
+)
+
+// runCommand runs a maintenance command instead of the server.
+func runCommand(configuration *config.Config, command string, args []string) {
+	switch command {
+	case "reprocess":
+		reprocess(configuration, args)
+	case "recalibrate":
+		recalibrate(configuration, args)
+	case "migrate":
+		migrate(configuration, args)
+	case "device":
+		updateDevice(configuration, args)
+	case "merge":
+		merge(configuration, args)
+	default:
+		log.Fatalf("error: unknown command %q", command)
+	}
+}
+
+// reprocess replays the payload archive through the current conversions.
+func reprocess(configuration *config.Config, args []string) {
+	flags := flag.NewFlagSet("reprocess", flag.ExitOnError)
+	device := flags.String("device", "", "mac address of the device to reprocess, all devices if empty")
+	flags.Parse(args)
+
+	a := api.New(configuration)
+	processed, err := a.Reprocess(*device)
+	if err != nil {
+		log.Fatalf("error: reprocessing failed after %d payloads: %v", processed, err)
+	}
+	log.Printf("reprocessed %d payloads", processed)
+}
+
+// recalibrate recomputes the converted values of a device from the raw values.
+func recalibrate(configuration *config.Config, args []string) {
+	flags := flag.NewFlagSet("recalibrate", flag.ExitOnError)
+	device := flags.String("device", "", "mac address of the device to recalibrate")
+	from := flags.String("from", "", "start of the time range (RFC 3339), all readings if empty")
+	to := flags.String("to", "", "end of the time range (RFC 3339), now if empty")
+	parameters := flags.String("parameters", "", "yaml file with calibration parameters for all readings, the configured history if empty")
+	flags.Parse(args)
+
+	if *device == "" {
+		log.Fatal("error: -device is required")
+	}
+
+	start, end := time.Unix(0, 0), time.Now()
+	if *from != "" {
+		start = parseTime(*from)
+	}
+	if *to != "" {
+		end = parseTime(*to)
+	}
+
+	var calibrationParameters *config.CalibrationParameters
+	if *parameters != "" {
+		yml, err := ioutil.ReadFile(*parameters)
+		if err != nil {
+			log.Fatalf("error: %v", err)
+		}
+		calibrationParameters = &config.CalibrationParameters{}
+		if err := yaml.Unmarshal(yml, calibrationParameters); err != nil {
+			log.Fatalf("error: %v", err)
+		}
+	}
+
+	a := api.New(configuration)
+	result, err := a.Recalibrate(*device, start, end, calibrationParameters)
+	if err != nil {
+		log.Fatalf("error: recalibrating %s failed: %v", *device, err)
+	}
+	log.Printf("recalibrated %d readings of %s with calibrations %v, skipped %d", result.Updated, *device, result.Calibrations, result.Skipped)
+}
+
+// updateDevice renames, describes, deletes or restores a device, only the
+// flags given are changed.
+func updateDevice(configuration *config.Config, args []string) {
+	flags := flag.NewFlagSet("device", flag.ExitOnError)
+	device := flags.String("device", "", "mac address of the device")
+	name := flags.String("name", "", "new name of the device")
+	notes := flags.String("notes", "", "notes on the device")
+	location := flags.String("location", "", "location of the device")
+	deleted := flags.Bool("delete", false, "delete the device, its history is kept")
+	restore := flags.Bool("restore", false, "restore a deleted device")
+	flags.Parse(args)
+
+	if *device == "" {
+		log.Fatal("error: -device is required")
+	}
+	if *deleted && *restore {
+		log.Fatal("error: -delete and -restore cannot be given together")
+	}
+
+	update := model.DeviceUpdate{}
+	if *deleted || *restore {
+		update.Deleted = deleted
+	}
+	flags.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "name":
+			update.Name = name
+		case "notes":
+			update.Notes = notes
+		case "location":
+			update.Location = location
+		}
+	})
+
+	a := api.New(configuration)
+	defer a.Store.Close()
+	result, err := a.UpdateDevice(*device, update)
+	if err != nil {
+		log.Fatalf("error: updating %s failed: %v", *device, err)
+	}
+	log.Printf("updated %s: name %q, notes %q, location %q, deleted %v", result.MacAddress, result.Name, result.Notes, result.Location, result.Deleted != nil)
+}
+
+// merge moves the history of a device to another one, e.g. after a board swap.
+func merge(configuration *config.Config, args []string) {
+	flags := flag.NewFlagSet("merge", flag.ExitOnError)
+	from := flags.String("from", "", "mac address of the device to merge and remove")
+	into := flags.String("into", "", "mac address of the device to keep")
+	flags.Parse(args)
+
+	if *from == "" || *into == "" {
+		log.Fatal("error: -from and -into are required")
+	}
+
+	a := api.New(configuration)
+	defer a.Store.Close()
+	if _, err := a.MergeDevices(*from, *into); err != nil {
+		log.Fatalf("error: merging %s into %s failed: %v", *from, *into, err)
+	}
+	log.Printf("merged %s into %s", *from, *into)
+}
+
+// migrate moves the schema of the sqlite or postgres database to a version, the
+// server applies all pending migrations on start anyway.
+func migrate(configuration *config.Config, args []string) {
+	flags := flag.NewFlagSet("migrate", flag.ExitOnError)
+	to := flags.Int("to", -1, "schema version to migrate up or down to, 0 removes all tables and -1 applies all migrations of the backend")
+	status := flags.Bool("status", false, "list the migrations and when they were applied")
+	flags.Parse(args)
+
+	var db *sql.DB
+	var err error
+	var migrationStatus func(db *sql.DB) ([]*migration.Status, error)
+	var migrateTo func(db *sql.DB, target int) (int, error)
+	var latest int
+	switch backend := configuration.Output.Backend; backend {
+	case "", storage.SQLite:
+		db, err = sqlite.Open(configuration.Output.DbFile)
+		migrationStatus, migrateTo, latest = sqlite.Status, sqlite.Migrate, sqlite.LatestVersion()
+	case storage.Postgres:
+		db, err = postgres.Open(configuration.Output.DSN)
+		migrationStatus, migrateTo, latest = postgres.Status, postgres.Migrate, postgres.LatestVersion()
+	default:
+		log.Fatalf("error: migrations are only available for the sqlite and postgres backends, not %q", backend)
+	}
+	if err != nil {
+		log.Fatalf("error: %v", err)
+	}
+	defer db.Close()
+
+	if *status {
+		migrations, err := migrationStatus(db)
+		if err != nil {
+			log.Fatalf("error: %v", err)
+		}
+		for _, m := range migrations {
+			applied := "pending"
+			if m.Applied > 0 {
+				applied = "applied " + time.Unix(m.Applied, 0).Format(time.RFC3339)
+			}
+			log.Printf("%3d %-50s %s", m.Version, m.Description, applied)
+		}
+		return
+	}
+
+	if *to == -1 {
+		*to = latest
+	}
+	count, err := migrateTo(db, *to)
+	if err != nil {
+		log.Fatalf("error: %v", err)
+	}
+	log.Printf("ran %d migrations, schema version is %d", count, *to)
+}
+
+func parseTime(value string) time.Time {
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		log.Fatalf("error: %v", err)
+	}
+	return t
+}
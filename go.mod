@@ -5,6 +5,7 @@ go 1.13
 require (
 	github.com/gin-contrib/cors v1.3.0
 	github.com/gin-gonic/gin v1.4.0
+	github.com/lib/pq v1.10.9
 	github.com/mattn/go-sqlite3 v1.14.3
 	gopkg.in/yaml.v2 v2.2.4
 )
@@ -4,23 +4,28 @@ import (
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
 	"koubachi-goserver/pkg/api"
-	"time"
+	"os"
 
 	"koubachi-goserver/pkg/config"
 )
 
 func main() {
 	configuration := config.New()
-	configuration.LastConfigChange = time.Now()
+
+	if len(os.Args) > 1 {
+		runCommand(configuration, os.Args[1], os.Args[2:])
+		return
+	}
 
 	router := gin.New()
 	router.Use(gin.Logger(), gin.Recovery(), cors.New(cors.Config{
-		AllowMethods:    []string{"GET", "POST", "PUT", "HEAD", "DELETE", "PUT"},
+		AllowMethods:    []string{"GET", "POST", "PUT", "PATCH", "HEAD", "DELETE"},
 		AllowHeaders:    []string{"Authorization", "Origin", "Content-Length", "Content-Type"},
 		AllowAllOrigins: true,
 	}))
 
 	a := api.New(configuration)
+	go a.Relay.Run(nil)
 
 	apiRouting := router.Group("/")
 	a.AttachRoutes(apiRouting)
@@ -0,0 +1,293 @@
+package alerts
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"koubachi-goserver/pkg/config"
+	"koubachi-goserver/pkg/model"
+	"koubachi-goserver/pkg/sensors"
+	"koubachi-goserver/pkg/storage"
+)
+
+var ErrUnknownAlert = errors.New("unknown alert")
+var ErrAlertResolved = errors.New("alert is already resolved")
+var ErrAlertNotFiring = errors.New("alert is not firing")
+
+// Engine evaluates the alert rules on every ingested reading. An alert is
+// pending while its condition holds for less than the duration of the rule,
+// firing once it held long enough and resolved when the value is back to
+// normal. Times of the evaluation are the times of the readings.
+type Engine struct {
+	Config *config.Config
+	Store  storage.Store
+	Client *http.Client
+
+	rules []Rule
+	// notifications are delivered in the background
+	pending sync.WaitGroup
+}
+
+// New parses the configured rules, invalid rules are logged and skipped.
+func New(config *config.Config, store storage.Store) *Engine {
+	engine := &Engine{
+		Config: config,
+		Store:  store,
+		Client: &http.Client{Timeout: 10 * time.Second},
+		rules:  make([]Rule, 0),
+	}
+
+	names := map[string]bool{}
+	for _, configured := range config.Alerts.Rules {
+		rule, err := ParseRule(configured)
+		if err == nil && names[rule.Name] {
+			err = errors.New("duplicate name")
+		}
+		if err != nil {
+			log.Printf("error: skipping alert rule %q: %v", configured.Name, err)
+			continue
+		}
+		for _, channel := range rule.Channels {
+			if _, found := config.Alerts.Channels[channel]; !found {
+				log.Printf("warning: unknown channel %q of alert rule %q", channel, rule.Name)
+			}
+		}
+		names[rule.Name] = true
+		engine.rules = append(engine.rules, rule)
+	}
+	return engine
+}
+
+// Rules returns the valid rules in the order of the configuration.
+func (e *Engine) Rules() []Rule {
+	return e.rules
+}
+
+type value struct {
+	timestamp int64
+	value     float64
+}
+
+// Evaluate runs the rules of a device on a batch of converted readings,
+// oldest first. Readings not newer than the last evaluation of a rule, e.g.
+// of a retransmitted batch, are skipped.
+func (e *Engine) Evaluate(macAddress string, deviceId int64, data *sensors.Data) {
+	if len(e.rules) == 0 {
+		return
+	}
+	// rules name a device by its configured name or the one it was renamed to
+	names := make([]string, 0, 2)
+	if device, found := e.Config.Device(macAddress); found {
+		names = append(names, device.Name)
+	}
+	if device := e.Store.GetDevice(macAddress); device != nil {
+		if device.Deleted > 0 {
+			return
+		}
+		names = append(names, device.Name)
+	}
+
+	sensorData := sensors.GetSensors()
+	values := map[string][]value{}
+	for _, reading := range data.Readings {
+		kind, name := storage.Classify(sensorData[reading.Code])
+		if kind == storage.KindReading {
+			values[name] = append(values[name], value{int64(reading.Timestamp), reading.ConvertedValue})
+		}
+	}
+	for _, v := range values {
+		sort.SliceStable(v, func(i, j int) bool {
+			return v[i].timestamp < v[j].timestamp
+		})
+	}
+
+	for _, rule := range e.rules {
+		if !rule.appliesTo(macAddress, names...) || len(values[rule.Sensor]) == 0 {
+			continue
+		}
+		alert := e.Store.GetLatestAlert(deviceId, rule.Name)
+		for _, v := range values[rule.Sensor] {
+			alert = e.evaluate(rule, macAddress, deviceId, alert, v)
+		}
+	}
+}
+
+// evaluate moves the latest alert of a rule and device on with a value and
+// returns the alert that is the latest afterwards, nil if there is none.
+func (e *Engine) evaluate(rule Rule, macAddress string, deviceId int64, alert *storage.Alert, v value) *storage.Alert {
+	active := alert != nil && alert.State != model.AlertResolved
+
+	switch {
+	case alert != nil && v.timestamp <= alert.Updated:
+		return alert
+
+	// a pending alert ends as soon as the condition fails, a firing one
+	// only once the value is back past the hysteresis
+	case active && alert.State == model.AlertPending && !rule.matches(v.value):
+		e.Store.DeleteAlert(alert.Id)
+		return e.Store.GetLatestAlert(deviceId, rule.Name)
+	case active && rule.cleared(v.value):
+		alert.Value, alert.Updated = v.value, v.timestamp
+		alert.State, alert.Resolved = model.AlertResolved, v.timestamp
+		e.write(alert)
+		e.notify(rule, alert)
+		return alert
+
+	case active:
+		alert.Value, alert.Updated = v.value, v.timestamp
+	case !rule.matches(v.value):
+		return alert
+	case alert != nil && v.timestamp < alert.Resolved+int64(rule.Cooldown/time.Second):
+		return alert
+	default:
+		alert = &storage.Alert{
+			Rule:       rule.Name,
+			DeviceId:   deviceId,
+			MacAddress: macAddress,
+			Sensor:     rule.Sensor,
+			State:      model.AlertPending,
+			Value:      v.value,
+			Threshold:  rule.Threshold,
+			Started:    v.timestamp,
+			Updated:    v.timestamp,
+		}
+	}
+
+	fired := false
+	if alert.State == model.AlertPending && v.timestamp-alert.Started >= int64(rule.For/time.Second) {
+		alert.State, alert.Triggered = model.AlertFiring, v.timestamp
+		fired = true
+	}
+	e.write(alert)
+	if fired {
+		e.notify(rule, alert)
+	}
+	return alert
+}
+
+func (e *Engine) write(alert *storage.Alert) {
+	if err := e.Store.WriteAlert(alert); err != nil {
+		log.Printf("error: storing alert %q of %s failed: %v", alert.Rule, alert.MacAddress, err)
+	}
+}
+
+// Acknowledge marks a firing alert as seen, it still resolves on its own.
+func (e *Engine) Acknowledge(id int64) (*storage.Alert, error) {
+	alert := e.Store.GetAlert(id)
+	switch {
+	case alert == nil:
+		return nil, ErrUnknownAlert
+	case alert.State == model.AlertResolved:
+		return nil, ErrAlertResolved
+	case alert.State == model.AlertPending:
+		return nil, ErrAlertNotFiring
+	case alert.State == model.AlertFiring:
+		alert.State, alert.Acknowledged = model.AlertAcknowledged, time.Now().Unix()
+		if err := e.Store.WriteAlert(alert); err != nil {
+			return nil, err
+		}
+	}
+	return alert, nil
+}
+
+// AcknowledgeDevice acknowledges all firing alerts of a device and returns
+// how many there were.
+func (e *Engine) AcknowledgeDevice(deviceId int64) int {
+	acknowledged := 0
+	for _, alert := range e.Store.GetAlerts(deviceId, true) {
+		if alert.State != model.AlertFiring {
+			continue
+		}
+		if _, err := e.Acknowledge(alert.Id); err != nil {
+			log.Printf("error: acknowledging alert %d failed: %v", alert.Id, err)
+			continue
+		}
+		acknowledged++
+	}
+	return acknowledged
+}
+
+// Resolve ends an alert by hand. If its condition still holds a new alert is
+// raised after the cooldown of the rule.
+func (e *Engine) Resolve(id int64) (*storage.Alert, error) {
+	alert := e.Store.GetAlert(id)
+	if alert == nil {
+		return nil, ErrUnknownAlert
+	}
+	if alert.State == model.AlertResolved {
+		return nil, ErrAlertResolved
+	}
+
+	triggered := alert.Triggered > 0
+	alert.State, alert.Resolved = model.AlertResolved, time.Now().Unix()
+	if err := e.Store.WriteAlert(alert); err != nil {
+		return nil, err
+	}
+	for _, rule := range e.rules {
+		if rule.Name == alert.Rule && triggered {
+			e.notify(rule, alert)
+		}
+	}
+	return alert, nil
+}
+
+// Wait blocks until all notifications started are delivered or failed.
+func (e *Engine) Wait() {
+	e.pending.Wait()
+}
+
+// AlertData converts a stored alert for the API and the notifications.
+func AlertData(alert *storage.Alert) model.Alert {
+	return model.Alert{
+		Id:           alert.Id,
+		Rule:         alert.Rule,
+		MacAddress:   alert.MacAddress,
+		Sensor:       alert.Sensor,
+		State:        alert.State,
+		Value:        alert.Value,
+		Threshold:    alert.Threshold,
+		Started:      time.Unix(alert.Started, 0),
+		Updated:      time.Unix(alert.Updated, 0),
+		Triggered:    optionalTime(alert.Triggered),
+		Acknowledged: optionalTime(alert.Acknowledged),
+		Resolved:     optionalTime(alert.Resolved),
+	}
+}
+
+func optionalTime(timestamp int64) *time.Time {
+	if timestamp == 0 {
+		return nil
+	}
+	t := time.Unix(timestamp, 0)
+	return &t
+}
+
+// describe returns the title and message of a notification.
+func (e *Engine) describe(rule Rule, alert *storage.Alert) (string, string) {
+	device := alert.MacAddress
+	if stored := e.Store.GetDevice(alert.MacAddress); stored != nil && stored.Name != "" {
+		device = fmt.Sprintf("%s (%s)", stored.Name, alert.MacAddress)
+	}
+
+	unit := ""
+	if sensorType, found := sensors.GetType(alert.Sensor); found && sensorType.Unit != "" {
+		unit = " " + sensorType.Unit
+	}
+
+	if alert.State == model.AlertResolved {
+		return fmt.Sprintf("resolved: %s of %s", rule.Name, device),
+			fmt.Sprintf("%s is %.2f%s, back to normal", alert.Sensor, alert.Value, unit)
+	}
+
+	direction := "above"
+	if rule.below() {
+		direction = "below"
+	}
+	return fmt.Sprintf("%s of %s", rule.Name, device),
+		fmt.Sprintf("%s is %.2f%s, %s %g%s since %s", alert.Sensor, alert.Value, unit, direction, alert.Threshold, unit, time.Unix(alert.Started, 0).UTC().Format(time.RFC3339))
+}
@@ -0,0 +1,191 @@
+package alerts
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"koubachi-goserver/pkg/config"
+	"koubachi-goserver/pkg/memory"
+	"koubachi-goserver/pkg/model"
+	"koubachi-goserver/pkg/sensors"
+)
+
+const testMacAddress = "001122334455"
+
+func TestParseRule(t *testing.T) {
+	tests := []struct {
+		condition string
+		expected  string
+	}{
+		{"soil_moisture < 1.5 for 6h", "soil_moisture < 1.5 6h0m0s"},
+		{"temperature < 5°C", "temperature < 5 0s"},
+		{" temperature >= -2.5 °C for 30m ", "temperature >= -2.5 30m0s"},
+		{"light>20000", "light > 20000 0s"},
+	}
+	for _, test := range tests {
+		rule, err := ParseRule(config.Rule{Name: "test", Condition: test.condition})
+		if err != nil {
+			t.Errorf("%q resulted in error: %s", test.condition, err)
+			continue
+		}
+		if received := fmt.Sprintf("%s %s %g %s", rule.Sensor, rule.Operator, rule.Threshold, rule.For); received != test.expected {
+			t.Errorf("%q: received %q, expected %q", test.condition, received, test.expected)
+		}
+	}
+
+	devices := map[string]string{
+		"soil_moisture < 1.5 for 6h on device X":  "X",
+		"temperature < 5°C on 001122334455":       "001122334455",
+		"light > 20000 for 30m on kitchen basil ": "kitchen basil",
+		"light > 20000 for 30m":                   "",
+	}
+	for condition, expected := range devices {
+		rule, err := ParseRule(config.Rule{Name: "test", Condition: condition})
+		if err != nil {
+			t.Errorf("%q resulted in error: %s", condition, err)
+		} else if rule.Device != expected {
+			t.Errorf("%q: received device %q, expected %q", condition, rule.Device, expected)
+		}
+	}
+
+	for _, condition := range []string{"soil_moisture < dry", "humidity > 50", "button > 1", "temperature < 5 lx", "light > 100 for 6 hours", "temperature = 5", "temperature < 5 on"} {
+		if _, err := ParseRule(config.Rule{Name: "test", Condition: condition}); err == nil {
+			t.Errorf("%q did not result in an error", condition)
+		}
+	}
+	if _, err := ParseRule(config.Rule{Condition: "temperature < 5"}); err == nil {
+		t.Errorf("rule without a name did not result in an error")
+	}
+}
+
+func TestAppliesTo(t *testing.T) {
+	tests := []struct {
+		rule     config.Rule
+		expected string
+	}{
+		{config.Rule{Condition: "temperature < 5"}, "[true true true]"},
+		{config.Rule{Condition: "temperature < 5 on basil"}, "[true false false]"},
+		{config.Rule{Condition: "temperature < 5 on device AABBCCDDEEFF"}, "[false true false]"},
+		{config.Rule{Condition: "temperature < 5 on basil", Devices: []string{"aabbccddeeff"}}, "[false false false]"},
+	}
+	for _, test := range tests {
+		test.rule.Name = "test"
+		rule, err := ParseRule(test.rule)
+		if err != nil {
+			t.Fatalf("%q resulted in error: %s", test.rule.Condition, err)
+		}
+		received := fmt.Sprint([]bool{
+			rule.appliesTo("001122334455", "pot", "basil"),
+			rule.appliesTo("aabbccddeeff", "fern"),
+			rule.appliesTo("665544332211"),
+		})
+		if received != test.expected {
+			t.Errorf("%q: received %s, expected %s", test.rule.Condition, received, test.expected)
+		}
+	}
+}
+
+func TestEvaluate(t *testing.T) {
+	var mu sync.Mutex
+	notifications := make([]Notification, 0)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		notification := Notification{}
+		json.NewDecoder(r.Body).Decode(&notification)
+		mu.Lock()
+		notifications = append(notifications, notification)
+		mu.Unlock()
+	}))
+	defer server.Close()
+
+	configuration := &config.Config{
+		Alerts: config.Alerts{
+			Rules: []config.Rule{{
+				Name:       "cold soil",
+				Condition:  "soil_temperature < 18 for 2h",
+				Hysteresis: 1,
+				Cooldown:   3 * time.Hour,
+				Channels:   []string{"hook"},
+			}},
+			Channels: map[string]config.Channel{
+				"hook": {Type: model.ChannelWebhook, URL: server.URL},
+				"log":  {Type: model.ChannelLog},
+			},
+		},
+	}
+	store := memory.New()
+	deviceId := store.GetDeviceId(testMacAddress, config.Device{Name: "pot"})
+	engine := New(configuration, store)
+
+	const t0, hour = 1600000000, 3600
+	steps := []struct {
+		timestamp int
+		value     float64
+		expected  string
+	}{
+		{t0, 17, model.AlertPending},
+		// the condition did not hold for two hours
+		{t0 + hour, 19, ""},
+		{t0 + 2*hour, 17, model.AlertPending},
+		{t0 + 3*hour, 17.5, model.AlertPending},
+		{t0 + 4*hour, 17, model.AlertFiring},
+		// retransmitted
+		{t0 + 4*hour, 25, model.AlertFiring},
+		// within the hysteresis
+		{t0 + 5*hour, 18.5, model.AlertFiring},
+		{t0 + 6*hour, 19, model.AlertResolved},
+		// within the cooldown
+		{t0 + 7*hour, 10, model.AlertResolved},
+		{t0 + 9*hour, 10, model.AlertPending},
+		{t0 + 11*hour, 10, model.AlertFiring},
+	}
+	for _, step := range steps {
+		engine.Evaluate(testMacAddress, deviceId, &sensors.Data{Readings: []*sensors.Reading{
+			{Timestamp: step.timestamp, Code: 11, ConvertedValue: step.value},
+		}})
+
+		state := ""
+		if alert := store.GetLatestAlert(deviceId, "cold soil"); alert != nil {
+			state = alert.State
+		}
+		if state != step.expected {
+			t.Errorf("%d %g: received state %q, expected %q", step.timestamp-t0, step.value, state, step.expected)
+		}
+	}
+
+	alert := store.GetLatestAlert(deviceId, "cold soil")
+	if alert, err := engine.Acknowledge(alert.Id); err != nil || alert.State != model.AlertAcknowledged || alert.Acknowledged == 0 {
+		t.Errorf("acknowledging resulted in %+v and error %v", alert, err)
+	}
+	if alert, err := engine.Resolve(alert.Id); err != nil || alert.State != model.AlertResolved {
+		t.Errorf("resolving resulted in %+v and error %v", alert, err)
+	}
+	if _, err := engine.Resolve(alert.Id); err != ErrAlertResolved {
+		t.Errorf("resolving again resulted in error %v, expected %v", err, ErrAlertResolved)
+	}
+	if history := store.GetAlerts(deviceId, false); len(history) != 2 {
+		t.Errorf("received %d alerts, expected 2", len(history))
+	}
+
+	engine.Wait()
+	mu.Lock()
+	defer mu.Unlock()
+	states := make([]string, 0)
+	for _, notification := range notifications {
+		states = append(states, notification.Alert.State)
+	}
+	// deliveries run in parallel, so only the number of states is fixed
+	if len(states) != 4 || strings.Count(strings.Join(states, " "), model.AlertFiring) != 2 {
+		t.Errorf("received notifications %v, expected two firing and two resolved", states)
+	}
+	for _, notification := range notifications {
+		if notification.Alert.State == model.AlertFiring && (notification.Title != "cold soil of pot ("+testMacAddress+")" || !strings.Contains(notification.Message, "below 18 °C")) {
+			t.Errorf("received notification %q %q", notification.Title, notification.Message)
+		}
+	}
+}
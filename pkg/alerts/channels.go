@@ -0,0 +1,155 @@
+package alerts
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"mime"
+	"net"
+	"net/http"
+	"net/smtp"
+	"sort"
+	"strings"
+
+	"koubachi-goserver/pkg/config"
+	"koubachi-goserver/pkg/model"
+	"koubachi-goserver/pkg/storage"
+)
+
+// Notification is sent when an alert fires or resolves, webhooks receive it
+// as json.
+type Notification struct {
+	Title   string      `json:"title"`
+	Message string      `json:"message"`
+	Alert   model.Alert `json:"alert"`
+}
+
+// notify delivers a notification of an alert to the channels of its rule in
+// the background, all channels if the rule names none.
+func (e *Engine) notify(rule Rule, alert *storage.Alert) {
+	title, message := e.describe(rule, alert)
+	notification := Notification{
+		Title:   title,
+		Message: message,
+		Alert:   AlertData(alert),
+	}
+
+	names := rule.Channels
+	if len(names) == 0 {
+		for name := range e.Config.Alerts.Channels {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+	}
+
+	for _, name := range names {
+		channel, found := e.Config.Alerts.Channels[name]
+		if !found {
+			continue
+		}
+		e.pending.Add(1)
+		go func(name string, channel config.Channel) {
+			defer e.pending.Done()
+			if err := e.send(channel, notification); err != nil {
+				log.Printf("error: notifying channel %s of alert %q failed: %v", name, rule.Name, err)
+			}
+		}(name, channel)
+	}
+}
+
+func (e *Engine) send(channel config.Channel, notification Notification) error {
+	firing := notification.Alert.State != model.AlertResolved
+
+	switch channel.Type {
+	case model.ChannelWebhook:
+		body, err := json.Marshal(notification)
+		if err != nil {
+			return err
+		}
+		return e.post(channel.URL, "application/json", body, nil)
+
+	case model.ChannelNtfy:
+		headers := map[string]string{
+			"Title":    notification.Title,
+			"Priority": "default",
+			"Tags":     "white_check_mark",
+		}
+		if firing {
+			headers["Priority"], headers["Tags"] = "high", "warning"
+		}
+		if channel.Token != "" {
+			headers["Authorization"] = "Bearer " + channel.Token
+		}
+		return e.post(channel.URL, "text/plain; charset=utf-8", []byte(notification.Message), headers)
+
+	case model.ChannelGotify:
+		priority := 4
+		if firing {
+			priority = 8
+		}
+		body, err := json.Marshal(map[string]interface{}{
+			"title":    notification.Title,
+			"message":  notification.Message,
+			"priority": priority,
+		})
+		if err != nil {
+			return err
+		}
+		return e.post(strings.TrimSuffix(channel.URL, "/")+"/message", "application/json", body, map[string]string{"X-Gotify-Key": channel.Token})
+
+	case model.ChannelSMTP:
+		return sendMail(channel, notification)
+
+	case model.ChannelLog:
+		log.Printf("alert: %s: %s", notification.Title, notification.Message)
+		return nil
+	}
+	return fmt.Errorf("unknown channel type %q", channel.Type)
+}
+
+// post sends a notification to an http endpoint.
+func (e *Engine) post(url, contentType string, body []byte, headers map[string]string) error {
+	request, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", contentType)
+	for key, value := range headers {
+		// header values cannot hold line breaks or non-ascii characters
+		request.Header.Set(key, mime.QEncoding.Encode("utf-8", value))
+	}
+
+	response, err := e.Client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode >= http.StatusBadRequest {
+		return fmt.Errorf("%s returned %s", url, response.Status)
+	}
+	return nil
+}
+
+// sendMail sends a notification as plain text mail, logging in only if a
+// username is configured.
+func sendMail(channel config.Channel, notification Notification) error {
+	host, _, err := net.SplitHostPort(channel.SMTPServer)
+	if err != nil {
+		return err
+	}
+	var auth smtp.Auth
+	if channel.Username != "" {
+		auth = smtp.PlainAuth("", channel.Username, channel.Password, host)
+	}
+
+	message := "From: " + channel.From + "\r\n" +
+		"To: " + strings.Join(channel.To, ", ") + "\r\n" +
+		"Subject: " + mime.QEncoding.Encode("utf-8", notification.Title) + "\r\n" +
+		"MIME-Version: 1.0\r\n" +
+		"Content-Type: text/plain; charset=utf-8\r\n" +
+		"\r\n" +
+		notification.Message + "\r\n"
+	return smtp.SendMail(channel.SMTPServer, auth, channel.From, channel.To, []byte(message))
+}
@@ -0,0 +1,122 @@
+package alerts
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"koubachi-goserver/pkg/config"
+	"koubachi-goserver/pkg/sensors"
+)
+
+// a sensor type, an operator, a threshold with an optional unit, an optional
+// duration and an optional device, e.g. "soil_moisture < 1.5 for 6h",
+// "temperature < 5°C" or "soil_moisture < 1.5 for 6h on device basil"
+var conditionPattern = regexp.MustCompile(`^\s*(\w+)\s*(<=|>=|<|>)\s*(-?\d+(?:\.\d+)?)\s*(\S+)?\s*(?:for\s+(\S+))?\s*(?:on\s+(?:device\s+)?(\S.*?))?\s*$`)
+
+// Rule is a configured rule with its parsed condition.
+type Rule struct {
+	config.Rule
+	Sensor    string
+	Operator  string
+	Threshold float64
+	// For is how long the condition has to hold before the alert fires
+	For time.Duration
+	// Device is the mac address or name of the device in the condition, the
+	// rule applies to all devices if empty
+	Device string
+}
+
+// ParseRule parses the condition of a configured rule.
+func ParseRule(rule config.Rule) (Rule, error) {
+	parsed := Rule{Rule: rule}
+	if rule.Name == "" {
+		return parsed, errors.New("missing name")
+	}
+	if rule.Hysteresis < 0 || rule.Cooldown < 0 {
+		return parsed, errors.New("negative hysteresis or cooldown")
+	}
+
+	match := conditionPattern.FindStringSubmatch(rule.Condition)
+	if match == nil {
+		return parsed, fmt.Errorf("invalid condition %q, expected e.g. \"soil_moisture < 1.5 for 6h on basil\"", rule.Condition)
+	}
+
+	sensorType, found := sensors.GetType(match[1])
+	if !found || sensorType.Event {
+		return parsed, fmt.Errorf("unknown sensor %q", match[1])
+	}
+	parsed.Sensor = sensorType.Name
+	parsed.Operator = match[2]
+	parsed.Threshold, _ = strconv.ParseFloat(match[3], 64)
+
+	if unit := match[4]; unit != "" && unit != sensorType.Unit {
+		return parsed, fmt.Errorf("unit %q of %s, expected %q", unit, sensorType.Name, sensorType.Unit)
+	}
+	if match[5] != "" {
+		d, err := time.ParseDuration(match[5])
+		if err != nil || d < 0 {
+			return parsed, fmt.Errorf("invalid duration %q", match[5])
+		}
+		parsed.For = d
+	}
+	parsed.Device = match[6]
+	return parsed, nil
+}
+
+// matches reports whether a value meets the condition.
+func (r Rule) matches(value float64) bool {
+	switch r.Operator {
+	case "<":
+		return value < r.Threshold
+	case "<=":
+		return value <= r.Threshold
+	case ">":
+		return value > r.Threshold
+	case ">=":
+		return value >= r.Threshold
+	}
+	return false
+}
+
+// cleared reports whether a value no longer meets the condition and is back
+// past the threshold by the hysteresis.
+func (r Rule) cleared(value float64) bool {
+	if r.matches(value) {
+		return false
+	}
+	if r.below() {
+		return value >= r.Threshold+r.Hysteresis
+	}
+	return value <= r.Threshold-r.Hysteresis
+}
+
+func (r Rule) below() bool {
+	return r.Operator == "<" || r.Operator == "<="
+}
+
+// appliesTo reports whether the rule applies to a device, the device of the
+// condition is matched by mac address or any of the names.
+func (r Rule) appliesTo(macAddress string, names ...string) bool {
+	if r.Device != "" {
+		found := strings.EqualFold(r.Device, macAddress)
+		for _, name := range names {
+			found = found || strings.EqualFold(r.Device, name)
+		}
+		if !found {
+			return false
+		}
+	}
+	if len(r.Devices) == 0 {
+		return true
+	}
+	for _, device := range r.Devices {
+		if device == macAddress {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,135 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"koubachi-goserver/pkg/model"
+	"koubachi-goserver/pkg/sensors"
+	"koubachi-goserver/pkg/storage"
+)
+
+// named bucket sizes in seconds, weeks start on monday
+var buckets = map[string]int64{
+	"1h": 3600,
+	"1d": 86400,
+	"1w": 604800,
+}
+
+// the first monday after the epoch
+const weekOffset = 4 * 86400
+
+// getAggregates returns the statistics of a sensor per time bucket. The
+// bucket query parameter is 1h, 1d (default), 1w or a duration, fn lists the
+// statistics: avg (default), min, max and percentiles like p50 or p90.
+func (api *API) getAggregates(c *gin.Context) {
+	sensorType, found := sensors.GetType(c.Param("sensor"))
+	if !found {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "unknown sensor"})
+		return
+	}
+	if sensorType.Event {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "events cannot be aggregated"})
+		return
+	}
+
+	query, fns, err := aggregateQuery(c)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	_, _, deviceId, ok := api.lookupDevice(c)
+	if !ok {
+		return
+	}
+	sensorId := api.Store.GetSensorId(sensorType.Name)
+	aggregates, err := api.Store.GetAggregates(deviceId, sensorId, query)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	data := make([]model.AggregateData, 0, len(aggregates))
+	for _, aggregate := range aggregates {
+		data = append(data, aggregateData(aggregate, fns))
+	}
+	c.JSON(http.StatusOK, data)
+}
+
+func aggregateQuery(c *gin.Context) (storage.AggregateQuery, []string, error) {
+	query := storage.AggregateQuery{}
+
+	from, to, err := timeRange(c)
+	if err != nil {
+		return query, nil, err
+	}
+	query.From, query.To = from, to
+
+	bucket := c.DefaultQuery("bucket", "1d")
+	if seconds, ok := buckets[bucket]; ok {
+		query.Bucket = seconds
+	} else if query.Bucket, err = parseStep(bucket); err != nil {
+		return query, nil, fmt.Errorf("invalid bucket %q", bucket)
+	}
+	if query.Bucket == buckets["1w"] {
+		query.Offset = weekOffset
+	}
+
+	fns := strings.Split(c.DefaultQuery("fn", "avg"), ",")
+	for _, fn := range fns {
+		switch {
+		case fn == "avg" || fn == "min" || fn == "max" || fn == "count":
+		case strings.HasPrefix(fn, "p"):
+			percentile, err := strconv.ParseFloat(fn[1:], 64)
+			if err != nil || percentile < 0 || percentile > 100 {
+				return query, nil, fmt.Errorf("invalid percentile %q", fn)
+			}
+			query.Percentiles = append(query.Percentiles, percentile/100)
+		default:
+			return query, nil, fmt.Errorf("invalid fn %q, expected avg, min, max, count or a percentile like p50", fn)
+		}
+	}
+	return query, fns, nil
+}
+
+// aggregateData returns a chart point with the requested statistics.
+func aggregateData(aggregate *storage.Aggregate, fns []string) model.AggregateData {
+	data := model.AggregateData{
+		T:     time.Unix(aggregate.Timestamp, 0),
+		Count: aggregate.Count,
+	}
+
+	percentile := 0
+	for i, fn := range fns {
+		var value float64
+		switch fn {
+		case "avg":
+			value = aggregate.Avg
+			data.Avg = &aggregate.Avg
+		case "min":
+			value = aggregate.Min
+			data.Min = &aggregate.Min
+		case "max":
+			value = aggregate.Max
+			data.Max = &aggregate.Max
+		case "count":
+			value = float64(aggregate.Count)
+		default:
+			value = aggregate.Percentiles[percentile]
+			percentile++
+			if data.Percentiles == nil {
+				data.Percentiles = map[string]float64{}
+			}
+			data.Percentiles[fn] = value
+		}
+		if i == 0 {
+			data.Y = value
+		}
+	}
+	return data
+}
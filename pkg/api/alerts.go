@@ -0,0 +1,86 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"koubachi-goserver/pkg/alerts"
+	"koubachi-goserver/pkg/model"
+	"koubachi-goserver/pkg/storage"
+)
+
+// getAlerts lists the alerts newest first, only those not resolved with
+// active=true and those of a single device with device=<mac address>.
+func (api *API) getAlerts(c *gin.Context) {
+	var deviceId int64
+	if macAddress := c.Query("device"); macAddress != "" {
+		device := api.Store.GetDevice(macAddress)
+		if device == nil {
+			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "unknown device"})
+			return
+		}
+		deviceId = device.Id
+	}
+
+	data := make([]model.Alert, 0)
+	for _, alert := range api.Store.GetAlerts(deviceId, c.Query("active") == "true") {
+		data = append(data, alerts.AlertData(alert))
+	}
+
+	c.JSON(http.StatusOK, data)
+}
+
+func (api *API) acknowledgeAlert(c *gin.Context) {
+	api.changeAlert(c, api.Alerts.Acknowledge)
+}
+
+func (api *API) resolveAlert(c *gin.Context) {
+	api.changeAlert(c, api.Alerts.Resolve)
+}
+
+// changeAlert runs a state change on the alert of the path.
+func (api *API) changeAlert(c *gin.Context, change func(id int64) (*storage.Alert, error)) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": alerts.ErrUnknownAlert.Error()})
+		return
+	}
+
+	alert, err := change(id)
+	switch err {
+	case nil:
+	case alerts.ErrUnknownAlert:
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	case alerts.ErrAlertResolved, alerts.ErrAlertNotFiring:
+		c.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	default:
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, alerts.AlertData(alert))
+}
+
+// getAlertRules lists the valid alert rules with their parsed conditions.
+func (api *API) getAlertRules(c *gin.Context) {
+	data := make([]model.AlertRule, 0)
+	for _, rule := range api.Alerts.Rules() {
+		data = append(data, model.AlertRule{
+			Name:       rule.Name,
+			Condition:  rule.Condition,
+			Sensor:     rule.Sensor,
+			Operator:   rule.Operator,
+			Threshold:  rule.Threshold,
+			For:        rule.For.String(),
+			Devices:    append([]string{}, rule.Devices...),
+			Hysteresis: rule.Hysteresis,
+			Cooldown:   rule.Cooldown.String(),
+			Channels:   append([]string{}, rule.Channels...),
+		})
+	}
+
+	c.JSON(http.StatusOK, data)
+}
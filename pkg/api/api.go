@@ -3,13 +3,17 @@ package api
 import (
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/gin-gonic/gin"
+	"koubachi-goserver/pkg/alerts"
 	"koubachi-goserver/pkg/config"
 	"koubachi-goserver/pkg/crypto"
 	"koubachi-goserver/pkg/model"
+	"koubachi-goserver/pkg/plants"
+	"koubachi-goserver/pkg/relay"
 	"koubachi-goserver/pkg/sensors"
-	"koubachi-goserver/pkg/sqlite"
+	"koubachi-goserver/pkg/storage"
 	"log"
 	"net/http"
 	"strings"
@@ -18,16 +22,30 @@ import (
 
 const ContentType = "application/x-koubachi-aes-encrypted"
 
+// endpoints of the device protocol
+const EndpointConnect = "connect"
+const EndpointConfig = "config"
+const EndpointReadings = "readings"
+
 type API struct {
 	Config *config.Config
-	Sqlite *sqlite.Database
+	Store  storage.Store
+	Relay  *relay.Relay
+	Plants plants.Catalogue
+	Alerts *alerts.Engine
 }
 
 func New(config *config.Config) *API {
-	return &API{
+	store := openStore(config.Output)
+	api := &API{
 		Config: config,
-		Sqlite: sqlite.New(config.Output.DbFile),
+		Store:  store,
+		Relay:  relay.New(config, store),
+		Plants: loadPlants(config),
+		Alerts: alerts.New(config, store),
 	}
+	api.storeCalibrations()
+	return api
 }
 
 func (api *API) AttachRoutes(r *gin.RouterGroup) {
@@ -44,153 +62,359 @@ func (api *API) AttachRoutes(r *gin.RouterGroup) {
 		{
 			device.GET("", api.getDevices)
 			device.PUT("/:macAddress", api.connect)
+			device.PATCH("/:macAddress", api.patchDevice)
+			device.DELETE("/:macAddress", api.deleteDevice)
+			device.POST("/:macAddress/merge", api.postMerge)
 			device.POST("/:macAddress/config", api.config)
 			device.POST("/:macAddress/readings", api.postReadings)
+			device.GET("/:macAddress/info", api.hideDeleted, api.getDeviceInfo)
+			device.GET("/:macAddress/status", api.hideDeleted, api.getStatus)
+			device.GET("/:macAddress/diagnostics", api.hideDeleted, api.getDiagnostics)
+			device.GET("/:macAddress/events", api.hideDeleted, api.getEvents)
+			device.GET("/:macAddress/calibrations", api.hideDeleted, api.getCalibrations)
+			device.POST("/:macAddress/recalibrate", api.hideDeleted, api.postRecalibration)
+
+			device.GET("/:macAddress/sensors/:sensor", api.hideDeleted, api.getReadings)
+			device.GET("/:macAddress/sensors/:sensor/aggregate", api.hideDeleted, api.getAggregates)
+		}
+
+		a.GET("/sensors", api.getSensorTypes)
+		a.GET("/plants", api.getPlants)
+
+		alert := a.Group("/alerts")
+		{
+			alert.GET("", api.getAlerts)
+			alert.POST("/:id/acknowledge", api.acknowledgeAlert)
+			alert.POST("/:id/resolve", api.resolveAlert)
+		}
+		a.GET("/alert_rules", api.getAlertRules)
+		a.GET("/relay_queue", api.getRelayQueue)
 
-			device.GET("/:macAddress/soil_moisture", api.getReadings(model.SoilMoisture))
-			device.GET("/:macAddress/battery_voltage", api.getReadings(model.BatteryVoltage))
-			device.GET("/:macAddress/soil_temperature", api.getReadings(model.SoilTemperature))
-			device.GET("/:macAddress/temperature", api.getReadings(model.Temperature))
-			device.GET("/:macAddress/light", api.getReadings(model.Light))
-			device.GET("/:macAddress/rssi", api.getReadings(model.Rssi))
+		pending := a.Group("/pending_devices")
+		{
+			pending.GET("", api.getPendingDevices)
+			pending.POST("/:macAddress", api.adoptPendingDevice)
+			pending.DELETE("/:macAddress", api.deletePendingDevice)
 		}
 	}
 }
 
 func (api *API) connect(c *gin.Context) {
 	macAddress := c.Param("macAddress")
-	deviceKey := api.Config.Devices[macAddress].Key
 
-	rawData, err := c.GetRawData()
-	if err != nil {
-		log.Panicf("error: %v", err)
+	device, key, body, ok := api.decryptRequest(c, EndpointConnect)
+	if !ok {
+		return
 	}
 
-	key, _ := hex.DecodeString(deviceKey)
-	body := crypto.Decrypt(key, rawData)
-
-	// do nothing with body
-	// persist.WriteSensor(macAddress, api.Config.Devices[macAddress])
-	_ = body
-
-	response := fmt.Sprintf("current_time=%d&last_config_change=%d", time.Now().Unix(), api.Config.LastConfigChange.Unix())
-	responseEncoded := crypto.Encrypt(key, []byte(response))
+	// keep track of firmware and hardware of the device
+	info, err := sensors.ParseDeviceInfo(body)
+	if err != nil {
+		log.Printf("error: invalid device info from %s: %v", macAddress, err)
+	} else {
+		api.Store.WriteDeviceInfo(macAddress, info, string(body), device)
+	}
 
-	c.Data(http.StatusOK, ContentType, responseEncoded)
+	response := fmt.Sprintf("current_time=%d&last_config_change=%d", time.Now().Unix(), api.lastConfigChange(macAddress, device))
+	api.respond(c, http.StatusOK, key, []byte(response))
 }
 
 func (api *API) config(c *gin.Context) {
 	macAddress := c.Param("macAddress")
-	deviceKey := api.Config.Devices[macAddress].Key
 
-	rawData, err := c.GetRawData()
-	if err != nil {
-		log.Panicf("error: %v", err)
+	device, key, body, ok := api.decryptRequest(c, EndpointConfig)
+	if !ok {
+		return
 	}
 
-	key, _ := hex.DecodeString(deviceKey)
-	body := crypto.Decrypt(key, rawData)
-
 	// do nothing with body
 	_ = body
 
 	// create sensor configuration
-	sensorData := sensors.GetSensors()
+	settings := sensors.GetSettings(device)
+	// the configuration sent is the one the device runs with from now on
+	api.Store.UpdateConfigChecksum(macAddress, device, settings.Checksum())
 	var configStrings []string
-	configStrings = append(configStrings,  fmt.Sprintf("current_time=%d", time.Now().Unix()))
-	configStrings = append(configStrings,  "transmit_interval=14400", "transmit_app_led=1", "sensor_app_led=0", "day_threshold=10.0")
-	for key, sensor := range sensorData {
-		configStrings = append(configStrings, fmt.Sprintf("sensor_enabled[%d]=%d", key, bool2int(sensor.Enabled)))
-		if sensor.PollingInterval > 0 {
-			configStrings = append(configStrings, fmt.Sprintf("sensor_polling_interval[%d]=%d", key, sensor.PollingInterval))
-		}
-	}
+	configStrings = append(configStrings, fmt.Sprintf("current_time=%d", time.Now().Unix()))
+	configStrings = append(configStrings, settings.Parameters()...)
 
 	response := []byte(strings.Join(configStrings[:], "&"))
-	responseEncoded := crypto.Encrypt(key, response)
-
-	c.Data(http.StatusOK, ContentType, responseEncoded)
+	api.respond(c, http.StatusOK, key, response)
 }
 
 func (api *API) postReadings(c *gin.Context) {
 	macAddress := c.Param("macAddress")
-	deviceKey := api.Config.Devices[macAddress].Key
 
-	rawData, err := c.GetRawData()
+	device, key, body, ok := api.decryptRequest(c, EndpointReadings)
+	if !ok {
+		return
+	}
+
+	data, err := parseReadings(body)
 	if err != nil {
-		log.Panicf("error: %v", err)
+		log.Printf("error: invalid readings from %s: %v", macAddress, err)
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+
+	// the device retransmits the whole batch if storing it failed
+	if err := api.ingestReadings(macAddress, device, data, false); err != nil {
+		log.Printf("error: storing readings from %s failed: %v", macAddress, err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
 	}
+	api.Relay.Enqueue(macAddress, device, body)
 
-	key, _ := hex.DecodeString(deviceKey)
-	body := crypto.Decrypt(key, rawData)
+	response := fmt.Sprintf("current_time=%d&last_config_change=%d", time.Now().Unix(), api.lastConfigChange(macAddress, device))
+	api.respond(c, http.StatusCreated, key, []byte(response))
+}
 
-	// do something with body
+func parseReadings(body []byte) (*sensors.Data, error) {
 	data := sensors.Data{}
-	_ = json.Unmarshal(body, &data)
+	if err := json.Unmarshal(body, &data); err != nil {
+		return nil, err
+	}
+	return &data, nil
+}
+
+// ingestReadings converts and stores the readings of a device, evaluates the
+// alert rules on them and runs the actions of new button presses. A backfill
+// of old readings, e.g. of an adopted device or archived payloads, is only
+// stored, alerts and actions are meant for what happens now.
+func (api *API) ingestReadings(macAddress string, device config.Device, data *sensors.Data, backfill bool) error {
+	convertReadings(device, data)
+
+	newEvents, err := api.Store.WriteData(macAddress, data, device)
+	if err != nil || backfill {
+		return err
+	}
+	api.Alerts.Evaluate(macAddress, api.Store.GetDeviceId(macAddress, device), data)
+
+	// actions only run once for retransmitted presses
+	for _, event := range newEvents {
+		api.buttonPressed(macAddress, device, event)
+	}
+	return nil
+}
 
+// convertReadings calculates the converted values with the calibration
+// parameters of the device valid when the readings were taken.
+func convertReadings(device config.Device, data *sensors.Data) {
 	sensorData := sensors.GetSensors()
-	for _, reading  := range data.Readings {
+	for _, reading := range data.Readings {
 		// map special sensor persist
 		mapper := sensorData[reading.Code]
 
 		// special conversion of value
 		reading.ConvertedValue = reading.RawValue
 		if mapper.ConversionFunc != nil {
-			reading.ConvertedValue = mapper.ConversionFunc(reading.RawValue, api.Config.Devices[macAddress].CalibrationParameters)
+			calibration := device.CalibrationAt(time.Unix(int64(reading.Timestamp), 0))
+			reading.ConvertedValue = mapper.ConversionFunc(reading.RawValue, calibration.CalibrationParameters)
 		}
-
-		api.Sqlite.WriteReading(macAddress, mapper.Type, reading, api.Config.Devices[macAddress])
 	}
-
-	response := fmt.Sprintf("current_time=%d&last_config_change=%d", time.Now().Unix(), api.Config.LastConfigChange.Unix())
-	responseEncoded := crypto.Encrypt(key, []byte(response))
-
-	c.Data(http.StatusCreated, ContentType, responseEncoded)
 }
 
-func (api *API) getReadings(sensor string) gin.HandlerFunc {
-	fn := func(c *gin.Context) {
-		macAddress := c.Param("macAddress")
-
-		// get necessary ids to query database
-		sensorId := api.Sqlite.GetSensorId(sensor)
-		deviceId := api.Sqlite.GetDeviceId(macAddress, api.Config.Devices[macAddress])
-		readings := api.Sqlite.GetReadings(deviceId, sensorId, 14)
+func (api *API) getReadings(c *gin.Context) {
+	sensorType, found := sensors.GetType(c.Param("sensor"))
+	if !found {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "unknown sensor"})
+		return
+	}
+	query, err := readingQuery(c)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
 
-		data := make([]model.ChartData, 0)
-		for _, reading  := range readings {
-			chartData := model.ChartData{
-				T: time.Unix(reading.Timestamp, 0),
-				Y: reading.ConvertedValue,
-			}
-			data = append(data, chartData)
+	// get necessary ids to query database
+	_, device, deviceId, ok := api.lookupDevice(c)
+	if !ok {
+		return
+	}
+	if sensorType.Event {
+		api.getEventReadings(c, deviceId, sensorType.Name, query)
+		return
+	}
+	sensorId := api.Store.GetSensorId(sensorType.Name)
+	readings := api.Store.GetReadings(deviceId, sensorId, query)
+	plant, settings := api.plant(device), sensors.GetSettings(device)
+
+	data := make([]model.ChartData, 0)
+	for _, reading  := range readings {
+		chartData := model.ChartData{
+			T:           time.Unix(reading.Timestamp, 0),
+			Y:           reading.ConvertedValue,
+			Calibration: reading.CalibrationId,
 		}
+		chartData.Verdict = judge(plant, settings, sensorType.Name, reading.ConvertedValue)
+		data = append(data, chartData)
+	}
+
+	c.JSON(http.StatusOK, data)
+}
 
-		c.JSON(http.StatusOK, data)
+// getSensorTypes lists the sensor types available at the readings endpoint.
+func (api *API) getSensorTypes(c *gin.Context) {
+	data := make([]model.SensorType, 0)
+	for _, t := range sensors.GetTypes() {
+		data = append(data, model.SensorType{
+			Name:        t.Name,
+			DisplayName: t.DisplayName,
+			Unit:        t.Unit,
+			Codes:       t.Codes,
+			Event:       t.Event,
+		})
 	}
-	return fn
+
+	c.JSON(http.StatusOK, data)
 }
 
 func (api *API) getDevices(c *gin.Context) {
+	if c.Query("status") == "true" {
+		api.getStatuses(c)
+		return
+	}
 
-	devices := api.Sqlite.GetDevices()
+	devices := api.Store.GetDevices()
 
+	// deleted devices are only listed if asked for
+	deleted := c.Query("deleted") == "true"
 	data := make([]model.Device, 0)
 	for _, device  := range devices {
-		deviceData := model.Device{
-			Id: device.Id,
-			MacAddress: device.MacAddress,
-			Name: device.Name,
+		if device.Deleted > 0 && !deleted {
+			continue
+		}
+		data = append(data, deviceData(device))
+	}
+
+	c.JSON(http.StatusOK, data)
+}
+
+func (api *API) getDiagnostics(c *gin.Context) {
+	_, _, deviceId, ok := api.lookupDevice(c)
+	if !ok {
+		return
+	}
+	diagnostics := api.Store.GetDiagnostics(deviceId, 14)
+
+	data := make([]model.Diagnostic, 0)
+	for _, diagnostic := range diagnostics {
+		data = append(data, model.Diagnostic{
+			Code:      diagnostic.Code,
+			Name:      diagnostic.Name,
+			Value:     diagnostic.Value,
+			Timestamp: time.Unix(diagnostic.Timestamp, 0),
+		})
+	}
+
+	c.JSON(http.StatusOK, data)
+}
+
+// lastConfigChange returns the unix time of the last change of the effective
+// configuration of a device.
+func (api *API) lastConfigChange(macAddress string, device config.Device) int64 {
+	settings := sensors.GetSettings(device)
+	return api.Store.UpdateConfigChecksum(macAddress, device, settings.Checksum())
+}
+
+func (api *API) getDeviceInfo(c *gin.Context) {
+	_, _, deviceId, ok := api.lookupDevice(c)
+	if !ok {
+		return
+	}
+	infos := api.Store.GetDeviceInfo(deviceId)
+
+	data := make([]model.DeviceInfo, 0)
+	for _, info := range infos {
+		deviceInfo := model.DeviceInfo{
+			FirmwareVersion:     info.FirmwareVersion,
+			HardwareProductType: info.HardwareProductType,
+			Parameters:          map[string]string{},
+			Timestamp:           time.Unix(info.Timestamp, 0),
+		}
+		if parsed, err := sensors.ParseDeviceInfo([]byte(info.Raw)); err == nil {
+			deviceInfo.Parameters = parsed.Parameters
 		}
-		data = append(data, deviceData)
+		data = append(data, deviceInfo)
 	}
 
 	c.JSON(http.StatusOK, data)
 }
 
-func bool2int(b bool) int {
-	if b {
-		return 1
+// decryptRequest reads and decrypts the body of a device request. If this
+// fails the request is aborted with a matching status code and ok is false.
+// Payloads of unknown devices are kept as pending until their key is known.
+func (api *API) decryptRequest(c *gin.Context, endpoint string) (device config.Device, key, body []byte, ok bool) {
+	macAddress := c.Param("macAddress")
+
+	rawData, err := c.GetRawData()
+	if err != nil {
+		log.Printf("error: reading request of %s failed: %v", macAddress, err)
+		c.AbortWithStatus(http.StatusBadRequest)
+		return device, nil, nil, false
+	}
+
+	device, found := api.Config.Device(macAddress)
+	if !found {
+		api.keepPending(c, macAddress, endpoint, rawData)
+		return device, nil, nil, false
+	}
+
+	key, body, keyIndex, err := decrypt(device, rawData)
+	if api.Config.Output.Archive {
+		api.Store.WritePayload(macAddress, endpoint, rawData, body)
+	}
+	if err != nil {
+		log.Printf("error: decrypting request of %s failed: %v", macAddress, err)
+		c.AbortWithStatus(errorStatus(err))
+		return device, nil, nil, false
+	}
+	if keyIndex > 0 {
+		log.Printf("warning: device %s still uses previous key %d", macAddress, keyIndex)
+	}
+	api.Store.SetLastSeen(macAddress, device, time.Now().Unix())
+	return device, key, body, true
+}
+
+// decrypt decrypts a payload with the current or one of the previous keys of
+// the device. It returns the key that matched and its index in device.Keys().
+func decrypt(device config.Device, data []byte) (key, body []byte, keyIndex int, err error) {
+	keys := make([][]byte, 0)
+	for _, deviceKey := range device.Keys() {
+		// a partially decoded key must not be used, Decrypt rejects the nil key
+		k, err := hex.DecodeString(deviceKey)
+		if err != nil {
+			k = nil
+		}
+		keys = append(keys, k)
+	}
+
+	body, keyIndex, err = crypto.DecryptWithKeys(keys, data)
+	if err != nil {
+		return nil, nil, -1, err
+	}
+	return keys[keyIndex], body, keyIndex, nil
+}
+
+// respond encrypts the response with the key the request was encrypted with.
+func (api *API) respond(c *gin.Context, status int, key, response []byte) {
+	responseEncoded, err := crypto.Encrypt(key, response)
+	if err != nil {
+		log.Printf("error: encrypting response for %s failed: %v", c.Param("macAddress"), err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	c.Data(status, ContentType, responseEncoded)
+}
+
+// errorStatus maps crypto errors to the status code returned to the device.
+func errorStatus(err error) int {
+	switch {
+	case errors.Is(err, crypto.ErrInvalidKey), errors.Is(err, crypto.ErrBadChecksum):
+		return http.StatusUnauthorized
+	case errors.Is(err, crypto.ErrShortCiphertext), errors.Is(err, crypto.ErrInvalidBlockSize):
+		return http.StatusBadRequest
 	}
-	return 0
+	return http.StatusInternalServerError
 }
\ No newline at end of file
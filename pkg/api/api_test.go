@@ -0,0 +1,1200 @@
+package api
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"koubachi-goserver/pkg/alerts"
+	"koubachi-goserver/pkg/config"
+	"koubachi-goserver/pkg/crypto"
+	"koubachi-goserver/pkg/model"
+	"koubachi-goserver/pkg/sensors"
+	"koubachi-goserver/pkg/sqlstore"
+)
+
+const testMacAddress = "001122334455"
+const testKey = "00112233445566778899aabbccddeeff"
+
+var timesResponse = regexp.MustCompile(`^current_time=\d+&last_config_change=\d+$`)
+
+func newTestAPI(t *testing.T) (*API, *gin.Engine) {
+	return newTestAPIWithOutput(t, config.Output{
+		DbFile: t.TempDir() + "/koubachi.db",
+	})
+}
+
+func newTestAPIWithOutput(t *testing.T, output config.Output) (*API, *gin.Engine) {
+	gin.SetMode(gin.TestMode)
+
+	configuration := &config.Config{
+		Output: output,
+		Devices: map[string]config.Device{
+			testMacAddress: {
+				Name: "pot",
+				Key:  testKey,
+				CalibrationParameters: config.CalibrationParameters{
+					SmuGain:            1.0,
+					MoistureContinuity: 8778.25,
+					MoistureMin:        3515.25,
+				},
+			},
+		},
+	}
+
+	a := New(configuration)
+	t.Cleanup(func() {
+		a.Store.Close()
+	})
+
+	router := gin.New()
+	a.AttachRoutes(router.Group("/"))
+	return a, router
+}
+
+// forEachBackend runs a test as a subtest against a new test API on every
+// storage backend.
+func forEachBackend(t *testing.T, test func(t *testing.T, a *API, router *gin.Engine)) {
+	outputs := []struct {
+		backend string
+		output  func(t *testing.T) config.Output
+	}{
+		{"sqlite", func(t *testing.T) config.Output {
+			return config.Output{DbFile: t.TempDir() + "/koubachi.db"}
+		}},
+		{"memory", func(t *testing.T) config.Output {
+			return config.Output{Backend: "memory"}
+		}},
+		{"postgres", func(t *testing.T) config.Output {
+			return config.Output{Backend: "postgres", DSN: postgresDSN(t)}
+		}},
+	}
+	for _, o := range outputs {
+		t.Run(o.backend, func(t *testing.T) {
+			a, router := newTestAPIWithOutput(t, o.output(t))
+			test(t, a, router)
+		})
+	}
+}
+
+// postgresDSN connects to a schema of its own in the database of
+// KOUBACHI_TEST_POSTGRES_DSN, which is dropped after the test. Without the
+// variable the test is skipped.
+func postgresDSN(t *testing.T) string {
+	dsn := os.Getenv("KOUBACHI_TEST_POSTGRES_DSN")
+	if dsn == "" {
+		t.Skip("KOUBACHI_TEST_POSTGRES_DSN is not set")
+	}
+
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	schema := fmt.Sprintf("koubachi_test_%d", time.Now().UnixNano())
+	if _, err := db.Exec("create schema " + schema); err != nil {
+		db.Close()
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		db.Exec("drop schema " + schema + " cascade")
+		db.Close()
+	})
+
+	if strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://") {
+		u, err := url.Parse(dsn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		query := u.Query()
+		query.Set("search_path", schema)
+		u.RawQuery = query.Encode()
+		return u.String()
+	}
+	return dsn + " search_path=" + schema
+}
+
+// readingsBody builds the readings payload of a device with the raw values of
+// a sensor code taken every interval seconds from start on.
+func readingsBody(start, interval, code int, values ...float64) []byte {
+	readings := make([]string, 0, len(values))
+	for i, value := range values {
+		readings = append(readings, fmt.Sprintf("[%d,%d,%g]", start+i*interval, code, value))
+	}
+	return []byte(fmt.Sprintf(`{"timestamp":%d,"readings":[%s]}`, start+len(values)*interval, strings.Join(readings, ",")))
+}
+
+// soilTemperatures are soil temperatures of 20 to 25 degrees every ten minutes.
+var soilTemperatures = readingsBody(1600000000, 600, 11, 22.5, 23.5, 24.5, 25.5, 26.5, 27.5)
+
+// client returns the connection of the SQLite database of the test API.
+func client(a *API) *sql.DB {
+	return a.Store.(*sqlstore.Database).Client
+}
+
+// deviceRequest sends an encrypted request like a device and returns the
+// recorded response with its decrypted body.
+func deviceRequest(t *testing.T, router *gin.Engine, method, path, key string, body []byte) (*httptest.ResponseRecorder, string) {
+	k, _ := hex.DecodeString(key)
+	encrypted, err := crypto.Encrypt(k, body)
+	if err != nil {
+		t.Fatalf("encrypt resulted in error: %s", err)
+	}
+	return rawRequest(t, router, method, path, key, encrypted)
+}
+
+func rawRequest(t *testing.T, router *gin.Engine, method, path, key string, body []byte) (*httptest.ResponseRecorder, string) {
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest(method, path, bytes.NewReader(body)))
+
+	if recorder.Code >= http.StatusBadRequest {
+		return recorder, ""
+	}
+	if contentType := recorder.Header().Get("Content-Type"); contentType != ContentType {
+		t.Errorf("received content type \"%s\", expected \"%s\"", contentType, ContentType)
+	}
+
+	k, _ := hex.DecodeString(key)
+	decrypted, err := crypto.Decrypt(k, recorder.Body.Bytes())
+	if err != nil {
+		t.Fatalf("decrypting response resulted in error: %s", err)
+	}
+	return recorder, string(decrypted)
+}
+
+func TestConnect(t *testing.T) {
+	a, router := newTestAPI(t)
+
+	announcement := "firmware_version=1.2.3&hardware_product_type=koubachi_plant_sensor"
+	recorder, response := deviceRequest(t, router, http.MethodPut, "/v1/smart_devices/"+testMacAddress, testKey, []byte(announcement))
+
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("received status %d, expected %d", recorder.Code, http.StatusOK)
+	}
+	if !timesResponse.MatchString(response) {
+		t.Errorf("received \"%s\", expected current_time and last_config_change", response)
+	}
+
+	deviceId := a.Store.GetDeviceId(testMacAddress, config.Device{})
+	infos := a.Store.GetDeviceInfo(deviceId)
+	if len(infos) != 1 || infos[0].FirmwareVersion != "1.2.3" || infos[0].HardwareProductType != "koubachi_plant_sensor" {
+		t.Errorf("device info not stored, received %+v", infos)
+	}
+}
+
+func TestConfig(t *testing.T) {
+	_, router := newTestAPI(t)
+
+	recorder, response := deviceRequest(t, router, http.MethodPost, "/v1/smart_devices/"+testMacAddress+"/config", testKey, []byte(""))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("received status %d, expected %d", recorder.Code, http.StatusOK)
+	}
+
+	expected := "transmit_interval=14400&transmit_app_led=1&sensor_app_led=0&day_threshold=10.0" +
+		"&sensor_enabled[1]=0&sensor_polling_interval[1]=3600" +
+		"&sensor_enabled[2]=1&sensor_polling_interval[2]=86400" +
+		"&sensor_enabled[6]=1" +
+		"&sensor_enabled[7]=1&sensor_polling_interval[7]=3600" +
+		"&sensor_enabled[8]=1&sensor_polling_interval[8]=3600" +
+		"&sensor_enabled[9]=1&sensor_polling_interval[9]=14400" +
+		"&sensor_enabled[10]=1&sensor_polling_interval[10]=7200" +
+		"&sensor_enabled[11]=1&sensor_polling_interval[11]=7200" +
+		"&sensor_enabled[12]=1&sensor_polling_interval[12]=3600" +
+		"&sensor_enabled[15]=1&sensor_polling_interval[15]=3600" +
+		"&sensor_enabled[29]=1&sensor_polling_interval[29]=3600" +
+		"&sensor_enabled[4096]=0&sensor_enabled[4112]=0&sensor_enabled[4113]=0&sensor_enabled[4114]=0" +
+		"&sensor_enabled[4115]=0&sensor_enabled[4116]=0&sensor_enabled[4128]=0" +
+		"&sensor_enabled[8192]=0&sensor_enabled[8193]=0&sensor_enabled[8194]=0&sensor_enabled[8195]=0"
+
+	parts := strings.SplitN(response, "&", 2)
+	if !regexp.MustCompile(`^current_time=\d+$`).MatchString(parts[0]) {
+		t.Errorf("received \"%s\", expected current_time first", parts[0])
+	}
+	if len(parts) != 2 || parts[1] != expected {
+		t.Errorf("received \"%s\", expected \"%s\"", response, expected)
+	}
+}
+
+func TestConfigOverrides(t *testing.T) {
+	a, router := newTestAPI(t)
+
+	interval, enabled, polling := 3600, false, 600
+	device, _ := a.Config.Device(testMacAddress)
+	device.TransmitInterval = &interval
+	device.Sensors = map[int]config.SensorSettings{
+		8:  {Enabled: &enabled},
+		12: {PollingInterval: &polling},
+	}
+	a.Config.SetDevice(testMacAddress, device)
+
+	_, response := deviceRequest(t, router, http.MethodPost, "/v1/smart_devices/"+testMacAddress+"/config", testKey, []byte(""))
+	values, err := url.ParseQuery(response)
+	if err != nil {
+		t.Fatalf("parsing response resulted in error: %s", err)
+	}
+
+	expected := map[string]string{
+		"transmit_interval":           "3600",
+		"sensor_enabled[8]":           "0",
+		"sensor_polling_interval[12]": "600",
+		"sensor_polling_interval[7]":  "3600",
+	}
+	for key, value := range expected {
+		if values.Get(key) != value {
+			t.Errorf("received %s=%s, expected %s", key, values.Get(key), value)
+		}
+	}
+}
+
+func TestLastConfigChange(t *testing.T) {
+	a, router := newTestAPI(t)
+	path := "/v1/smart_devices/" + testMacAddress
+
+	deviceRequest(t, router, http.MethodPut, path, testKey, []byte(""))
+	client(a).Exec("update device_configs set lastchange = 1")
+
+	// unchanged configuration keeps the timestamp
+	_, response := deviceRequest(t, router, http.MethodPut, path, testKey, []byte(""))
+	values, _ := url.ParseQuery(response)
+	if values.Get("last_config_change") != "1" {
+		t.Errorf("received last_config_change=%s, expected 1", values.Get("last_config_change"))
+	}
+
+	interval := 3600
+	device, _ := a.Config.Device(testMacAddress)
+	device.TransmitInterval = &interval
+	a.Config.SetDevice(testMacAddress, device)
+
+	_, response = deviceRequest(t, router, http.MethodPost, path+"/readings", testKey, []byte(`{"timestamp":1,"readings":[]}`))
+	values, _ = url.ParseQuery(response)
+	if values.Get("last_config_change") == "1" {
+		t.Errorf("last_config_change not updated after a configuration change")
+	}
+}
+
+func TestPostReadings(t *testing.T) {
+	a, router := newTestAPI(t)
+	path := "/v1/smart_devices/" + testMacAddress + "/readings"
+	body := []byte(`{"timestamp":1600000100,"readings":[` +
+		`[1600000000,2,3.05],` +
+		`[1600000000,11,22.5],` +
+		`[1600000000,12,6146.75],` +
+		`[1600000000,6,1500],` +
+		`[1600000000,4113,3]]}`)
+
+	// the retransmitted batch must not be stored twice
+	for i := 0; i < 2; i++ {
+		recorder, response := deviceRequest(t, router, http.MethodPost, path, testKey, body)
+		if recorder.Code != http.StatusCreated {
+			t.Fatalf("received status %d, expected %d", recorder.Code, http.StatusCreated)
+		}
+		if !timesResponse.MatchString(response) {
+			t.Errorf("received \"%s\", expected current_time and last_config_change", response)
+		}
+	}
+
+	expected := map[string]float64{
+		"battery_voltage":  3.05,
+		"soil_temperature": 20.0,
+		"soil_moisture":    2.1984,
+	}
+	rows, err := client(a).Query("select s.name, r.convertedvalue from readings r join sensors s on s.id = r.sensor")
+	if err != nil {
+		t.Fatalf("query resulted in error: %s", err)
+	}
+	defer rows.Close()
+
+	count := 0
+	for rows.Next() {
+		var name string
+		var value float64
+		rows.Scan(&name, &value)
+		if want, ok := expected[name]; !ok || math.Abs(value-want) > 0.001 {
+			t.Errorf("received %s=%f, expected %f", name, value, want)
+		}
+		count++
+	}
+	if count != len(expected) {
+		t.Errorf("received %d readings, expected %d", count, len(expected))
+	}
+
+	deviceId := a.Store.GetDeviceId(testMacAddress, config.Device{})
+	if events := a.Store.GetEvents(deviceId, 100000); len(events) != 1 || events[0].Duration != 1.5 {
+		t.Errorf("button press not stored as event, received %+v", events)
+	}
+	if diagnostics := a.Store.GetDiagnostics(deviceId, 100000); len(diagnostics) != 1 || diagnostics[0].Name != "wifi_reconnect_count" {
+		t.Errorf("statistics not stored as diagnostic, received %+v", diagnostics)
+	}
+}
+
+func TestDeviceErrors(t *testing.T) {
+	a, router := newTestAPI(t)
+	path := "/v1/smart_devices/" + testMacAddress
+
+	tests := []struct {
+		name     string
+		path     string
+		key      string
+		body     []byte
+		raw      bool
+		expected int
+	}{
+		{"unknown device", "/v1/smart_devices/aabbccddeeff", testKey, []byte(""), false, http.StatusNotFound},
+		{"invalid mac address", "/v1/smart_devices/pot", testKey, []byte(""), false, http.StatusBadRequest},
+		{"oversized payload", "/v1/smart_devices/aabbccddeeff", testKey, make([]byte, maxPendingPayloadSize+16), true, http.StatusRequestEntityTooLarge},
+		{"wrong key", path, "ffeeddccbbaa99887766554433221100", []byte(""), false, http.StatusUnauthorized},
+		{"short payload", path, testKey, []byte("short"), true, http.StatusBadRequest},
+		{"invalid readings", path + "/readings", testKey, []byte("no json"), false, http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		var recorder *httptest.ResponseRecorder
+		method := http.MethodPut
+		if strings.HasSuffix(test.path, "/readings") {
+			method = http.MethodPost
+		}
+		if test.raw {
+			recorder, _ = rawRequest(t, router, method, test.path, test.key, test.body)
+		} else {
+			recorder, _ = deviceRequest(t, router, method, test.path, test.key, test.body)
+		}
+		if recorder.Code != test.expected {
+			t.Errorf("%s: received status %d, expected %d", test.name, recorder.Code, test.expected)
+		}
+	}
+
+	if pending := a.Store.GetPendingPayloads("aabbccddeeff"); len(pending) != 1 {
+		t.Errorf("received %d pending payloads of the unknown device, expected 1", len(pending))
+	}
+}
+
+func TestPendingLimit(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, a *API, router *gin.Engine) {
+		a.Config.Output.PendingLimit = 2
+
+		for _, body := range []string{"first", "second", "third"} {
+			deviceRequest(t, router, http.MethodPut, "/v1/smart_devices/aabbccddeeff", testKey, []byte(body))
+		}
+		deviceRequest(t, router, http.MethodPut, "/v1/smart_devices/665544332211", testKey, []byte("other"))
+
+		// the oldest payload of the device is dropped, other devices keep theirs
+		pending := a.Store.GetPendingPayloads("aabbccddeeff")
+		k, _ := hex.DecodeString(testKey)
+		bodies := make([]string, 0)
+		for _, payload := range pending {
+			body, _ := crypto.Decrypt(k, payload.Payload)
+			bodies = append(bodies, string(body))
+		}
+		if fmt.Sprint(bodies) != "[second third]" {
+			t.Errorf("received pending payloads %v, expected [second third]", bodies)
+		}
+		if other := a.Store.GetPendingPayloads("665544332211"); len(other) != 1 {
+			t.Errorf("received %d pending payloads of the other device, expected 1", len(other))
+		}
+	})
+}
+
+func TestAdoptPendingDevice(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, a *API, router *gin.Engine) {
+		const macAddress = "aabbccddeeff"
+		path := "/v1/smart_devices/" + macAddress
+		request := func(method, path, body string) *httptest.ResponseRecorder {
+			recorder := httptest.NewRecorder()
+			router.ServeHTTP(recorder, httptest.NewRequest(method, path, strings.NewReader(body)))
+			return recorder
+		}
+		a.Config.Output.PendingLimit = 2
+
+		// soil temperatures of 17.5, 18.5 and 19.5 an hour apart, the first is dropped
+		for i, value := range []float64{20, 21, 22} {
+			recorder, _ := deviceRequest(t, router, http.MethodPost, path+"/readings", testKey, readingsBody(1600000000+i*3600, 600, 11, value))
+			if recorder.Code != http.StatusNotFound {
+				t.Errorf("received status %d from an unknown device, expected %d", recorder.Code, http.StatusNotFound)
+			}
+		}
+		var pending []model.PendingDevice
+		json.Unmarshal(request(http.MethodGet, "/v1/pending_devices", "").Body.Bytes(), &pending)
+		if len(pending) != 1 || pending[0].MacAddress != macAddress || pending[0].Payloads != 2 {
+			t.Errorf("received pending devices %+v, expected %s with 2 payloads", pending, macAddress)
+		}
+
+		// a wrong key changes nothing
+		recorder := request(http.MethodPost, "/v1/pending_devices/"+macAddress, `{"name":"new pot","key":"ffeeddccbbaa99887766554433221100"}`)
+		if recorder.Code != http.StatusUnauthorized {
+			t.Errorf("received status %d adopting with a wrong key, expected %d", recorder.Code, http.StatusUnauthorized)
+		}
+		if _, found := a.Config.Device(macAddress); found {
+			t.Errorf("device was added with a wrong key")
+		}
+		if payloads := a.Store.GetPendingPayloads(macAddress); len(payloads) != 2 {
+			t.Errorf("received %d pending payloads after a wrong key, expected 2", len(payloads))
+		}
+
+		recorder = request(http.MethodPost, "/v1/pending_devices/"+macAddress, `{"name":"new pot","key":"`+testKey+`"}`)
+		var imported model.PendingDeviceImport
+		if err := json.Unmarshal(recorder.Body.Bytes(), &imported); err != nil || recorder.Code != http.StatusOK || imported.Imported != 2 {
+			t.Errorf("received status %d %s, expected 2 imported payloads", recorder.Code, recorder.Body.String())
+		}
+		if device, found := a.Config.Device(macAddress); !found || device.Name != "new pot" || device.Key != testKey {
+			t.Errorf("received device %+v, expected the adopted device", device)
+		}
+		if payloads := a.Store.GetPendingPayloads(macAddress); len(payloads) != 0 {
+			t.Errorf("received %d pending payloads after adopting, expected none", len(payloads))
+		}
+
+		var points []model.ChartData
+		json.Unmarshal(request(http.MethodGet, path+"/sensors/soil_temperature?from=0", "").Body.Bytes(), &points)
+		values := make([]float64, 0)
+		for _, point := range points {
+			values = append(values, point.Y)
+		}
+		if fmt.Sprint(values) != "[18.5 19.5]" {
+			t.Errorf("received %v, expected the readings of the kept payloads [18.5 19.5]", values)
+		}
+	})
+}
+
+func TestRelayQueue(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, a *API, router *gin.Engine) {
+		path := "/v1/smart_devices/" + testMacAddress + "/readings"
+
+		// the relay worker is not running, the payloads stay queued
+		device, _ := a.Config.Device(testMacAddress)
+		device.Relays = []config.Relay{{URL: "http://upstream.invalid"}}
+		a.Config.SetDevice(testMacAddress, device)
+		deviceRequest(t, router, http.MethodPost, path, testKey, []byte(`{"timestamp":1600000100,"readings":[[1600000000,11,22.5]]}`))
+		deviceRequest(t, router, http.MethodPost, path, testKey, []byte(`{"timestamp":1600003700,"readings":[[1600003600,11,22.5]]}`))
+
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/v1/relay_queue", nil))
+		var queue []model.RelayQueue
+		json.Unmarshal(recorder.Body.Bytes(), &queue)
+		if len(queue) != 1 || queue[0].MacAddress != testMacAddress || queue[0].URL != "http://upstream.invalid" || queue[0].Payloads != 2 {
+			t.Errorf("received queue %s, expected two payloads", recorder.Body.String())
+		}
+	})
+}
+
+func TestPreviousKey(t *testing.T) {
+	a, router := newTestAPI(t)
+	previousKey := "ffeeddccbbaa99887766554433221100"
+
+	device, _ := a.Config.Device(testMacAddress)
+	device.PreviousKeys = []string{previousKey}
+	a.Config.SetDevice(testMacAddress, device)
+
+	// the response has to be encrypted with the key of the request
+	recorder, response := deviceRequest(t, router, http.MethodPut, "/v1/smart_devices/"+testMacAddress, previousKey, []byte(""))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("received status %d, expected %d", recorder.Code, http.StatusOK)
+	}
+	if !timesResponse.MatchString(response) {
+		t.Errorf("received \"%s\", expected current_time and last_config_change", response)
+	}
+}
+
+func TestMemoryStore(t *testing.T) {
+	a, router := newTestAPIWithOutput(t, config.Output{Backend: "memory"})
+	path := "/v1/smart_devices/" + testMacAddress + "/readings"
+	body := []byte(`{"timestamp":1600000100,"readings":[[1600000000,11,22.5],[1600000000,6,1500]]}`)
+
+	for i := 0; i < 2; i++ {
+		recorder, _ := deviceRequest(t, router, http.MethodPost, path, testKey, body)
+		if recorder.Code != http.StatusCreated {
+			t.Fatalf("received status %d, expected %d", recorder.Code, http.StatusCreated)
+		}
+	}
+
+	deviceId := a.Store.GetDeviceId(testMacAddress, config.Device{})
+	sensorId := a.Store.GetSensorId(model.SoilTemperature)
+	if readings := a.Store.GetRawReadings(deviceId, 0, 1700000000); len(readings) != 1 || readings[0].SensorId != sensorId || readings[0].ConvertedValue != 20.0 {
+		t.Errorf("reading not stored once, received %+v", readings)
+	}
+	if events := a.Store.GetEvents(deviceId, 100000); len(events) != 1 {
+		t.Errorf("received %d button events, expected 1", len(events))
+	}
+}
+
+func TestWriteDataErrors(t *testing.T) {
+	a, _ := newTestAPI(t)
+
+	// inserting a new device or sensor fails, e.g. as the database is locked
+	tests := []struct {
+		name       string
+		trigger    string
+		macAddress string
+		body       string
+	}{
+		{"device", "create trigger fail before insert on devices begin select raise(fail, 'database is locked'); end", "aabbccddeeff", `{"timestamp":1600000100,"readings":[[1600000000,11,22.5]]}`},
+		{"sensor", "create trigger fail before insert on sensors begin select raise(fail, 'database is locked'); end", testMacAddress, `{"timestamp":1600000100,"readings":[[1600000000,11,22.5],[1600000000,2,2900]]}`},
+	}
+	for _, test := range tests {
+		if _, err := client(a).Exec(test.trigger); err != nil {
+			t.Fatalf("%s: creating trigger resulted in error: %s", test.name, err)
+		}
+
+		data, _ := parseReadings([]byte(test.body))
+		if err := a.ingestReadings(test.macAddress, config.Device{Name: "pot"}, data, false); err == nil {
+			t.Errorf("%s: storing readings succeeded, expected an error", test.name)
+		}
+		var readings int
+		client(a).QueryRow("select count(*) from readings").Scan(&readings)
+		if readings != 0 {
+			t.Errorf("%s: received %d readings, expected none of the failed batch", test.name, readings)
+		}
+
+		client(a).Exec("drop trigger fail")
+	}
+}
+
+func TestSensorsOfSameType(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, a *API, router *gin.Engine) {
+		path := "/v1/smart_devices/" + testMacAddress + "/readings"
+
+		// temperatures of codes 7 and 15 and light of codes 8 and 29 taken at the same time, sent twice
+		body := []byte(`{"timestamp":1600000100,"readings":[[1600000000,7,0.5],[1600000000,15,22.5],[1600000000,8,0.1],[1600000000,29,1500]]}`)
+		for i := 0; i < 2; i++ {
+			if recorder, _ := deviceRequest(t, router, http.MethodPost, path, testKey, body); recorder.Code != http.StatusCreated {
+				t.Fatalf("received status %d, expected %d", recorder.Code, http.StatusCreated)
+			}
+		}
+
+		deviceId := a.Store.GetDeviceId(testMacAddress, config.Device{})
+		codes := make([]int, 0)
+		for _, reading := range a.Store.GetRawReadings(deviceId, 0, 1700000000) {
+			codes = append(codes, reading.Code)
+		}
+		sort.Ints(codes)
+		if fmt.Sprint(codes) != "[7 8 15 29]" {
+			t.Errorf("received readings of codes %v, expected [7 8 15 29]", codes)
+		}
+
+		// the status shows the sensor with the lower code
+		status := a.deviceStatus(testMacAddress, config.Device{}, time.Unix(1600000100, 0))
+		if value := status.Sensors[model.Light]; value == nil || value.Value == 1500 {
+			t.Errorf("received light %+v, expected the one of code 8", value)
+		}
+	})
+}
+
+func TestGetReadings(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, _ *API, router *gin.Engine) {
+		path := "/v1/smart_devices/" + testMacAddress
+
+		deviceRequest(t, router, http.MethodPost, path+"/readings", testKey, soilTemperatures)
+
+		tests := []struct {
+			query    string
+			expected []float64
+		}{
+			{"from=1600000000&to=1600003000", []float64{20, 21, 22, 23, 24, 25}},
+			{"from=2020-09-13T12:36:40Z&to=1600001200", []float64{21, 22}},
+			{"from=1600000000&to=1600003000&order=desc&limit=2", []float64{25, 24}},
+			{"from=1600000000&to=1600003000&step=1h", []float64{21.5, 24.5}},
+			{"from=1600000000&to=1600003000&step=3600&order=desc&limit=1", []float64{24.5}},
+		}
+		for _, test := range tests {
+			recorder := httptest.NewRecorder()
+			router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, path+"/sensors/soil_temperature?"+test.query, nil))
+
+			var data []model.ChartData
+			if err := json.Unmarshal(recorder.Body.Bytes(), &data); err != nil {
+				t.Fatalf("%s: decoding response resulted in error: %s", test.query, err)
+			}
+			values := make([]float64, 0)
+			for _, point := range data {
+				values = append(values, math.Round(point.Y*10)/10)
+			}
+			if fmt.Sprint(values) != fmt.Sprint(test.expected) {
+				t.Errorf("%s: received %v, expected %v", test.query, values, test.expected)
+			}
+		}
+
+		for _, query := range []string{"order=up", "limit=-1", "step=0", "from=yesterday", "from=1600003000&to=1600000000"} {
+			recorder := httptest.NewRecorder()
+			router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, path+"/sensors/soil_temperature?"+query, nil))
+			if recorder.Code != http.StatusBadRequest {
+				t.Errorf("%s: received status %d, expected %d", query, recorder.Code, http.StatusBadRequest)
+			}
+		}
+	})
+}
+
+func TestGetAggregates(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, _ *API, router *gin.Engine) {
+		path := "/v1/smart_devices/" + testMacAddress
+
+		deviceRequest(t, router, http.MethodPost, path+"/readings", testKey, soilTemperatures)
+
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, path+"/sensors/soil_temperature/aggregate?from=1600000000&to=1600003000&bucket=1h&fn=min,max,avg,p50", nil))
+
+		var data []model.AggregateData
+		if err := json.Unmarshal(recorder.Body.Bytes(), &data); err != nil {
+			t.Fatalf("decoding response resulted in error: %s", err)
+		}
+
+		expected := []string{"1599998400 20 4 20 23 21.5 21", "1600002000 24 2 24 25 24.5 24"}
+		if len(data) != len(expected) {
+			t.Fatalf("received %d buckets, expected %d", len(data), len(expected))
+		}
+		for i, point := range data {
+			if point.Min == nil || point.Max == nil || point.Avg == nil {
+				t.Fatalf("statistics missing in %+v", point)
+			}
+			received := fmt.Sprintf("%d %g %d %g %g %g %g", point.T.Unix(), math.Round(point.Y*10)/10, point.Count,
+				math.Round(*point.Min*10)/10, math.Round(*point.Max*10)/10, math.Round(*point.Avg*10)/10, math.Round(point.Percentiles["p50"]*10)/10)
+			if received != expected[i] {
+				t.Errorf("received %s, expected %s", received, expected[i])
+			}
+		}
+
+		for _, query := range []string{"bucket=1y", "fn=median", "fn=p101"} {
+			recorder := httptest.NewRecorder()
+			router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, path+"/sensors/soil_temperature/aggregate?"+query, nil))
+			if recorder.Code != http.StatusBadRequest {
+				t.Errorf("%s: received status %d, expected %d", query, recorder.Code, http.StatusBadRequest)
+			}
+		}
+	})
+}
+
+func TestStatus(t *testing.T) {
+	_, router := newTestAPI(t)
+	path := "/v1/smart_devices/" + testMacAddress
+
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, path+"/status", nil))
+	var status model.DeviceStatus
+	json.Unmarshal(recorder.Body.Bytes(), &status)
+	if status.Health != model.HealthUnknown || status.LastSeen != nil {
+		t.Errorf("received health %s, expected %s before the first request", status.Health, model.HealthUnknown)
+	}
+
+	body := []byte(`{"timestamp":1600000100,"readings":[[1600000000,2,2.32],[1600000000,11,22.5],[1600003600,11,23.5],[1600000000,6,1500]]}`)
+	deviceRequest(t, router, http.MethodPost, path+"/readings", testKey, body)
+
+	recorder = httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, path+"/status", nil))
+	if err := json.Unmarshal(recorder.Body.Bytes(), &status); err != nil {
+		t.Fatalf("decoding response resulted in error: %s", err)
+	}
+
+	if status.LastSeen == nil || status.BatteryLevel == nil || *status.BatteryLevel != 15 {
+		t.Errorf("received last seen %v and battery level %v, expected a time and 15", status.LastSeen, status.BatteryLevel)
+	}
+	if status.Health != model.HealthWarning || fmt.Sprint(status.Problems) != "[battery_low]" {
+		t.Errorf("received health %s %v, expected %s [battery_low]", status.Health, status.Problems, model.HealthWarning)
+	}
+	if value := status.Sensors[model.SoilTemperature]; value == nil || value.Value != 21 || value.Timestamp.Unix() != 1600003600 {
+		t.Errorf("received soil temperature %+v, expected the latest reading", value)
+	}
+	if value := status.Sensors[model.Button]; value == nil || value.Value != 1.5 {
+		t.Errorf("received button %+v, expected the last press", value)
+	}
+	if value, ok := status.Sensors[model.BoardTemperature]; !ok || value != nil {
+		t.Errorf("received board temperature %+v, expected null", value)
+	}
+
+	recorder = httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/v1/smart_devices?status=true", nil))
+	var statuses []model.DeviceStatus
+	if err := json.Unmarshal(recorder.Body.Bytes(), &statuses); err != nil || len(statuses) != 1 || statuses[0].MacAddress != testMacAddress {
+		t.Errorf("received %s, expected the status of the configured device", recorder.Body.String())
+	}
+
+	recorder = httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/v1/smart_devices/aabbccddeeff/status", nil))
+	if recorder.Code != http.StatusNotFound {
+		t.Errorf("received status %d for an unknown device, expected %d", recorder.Code, http.StatusNotFound)
+	}
+}
+
+// TestReadUnknownDevice checks reading the data of a device neither configured
+// nor stored is answered with 404 and does not store the device.
+func TestReadUnknownDevice(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, a *API, router *gin.Engine) {
+		path := "/v1/smart_devices/aabbccddeeff"
+		for _, endpoint := range []string{"/info", "/diagnostics", "/events", "/calibrations", "/sensors/soil_temperature", "/sensors/button", "/sensors/soil_temperature/aggregate"} {
+			recorder := httptest.NewRecorder()
+			router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, path+endpoint, nil))
+			if recorder.Code != http.StatusNotFound {
+				t.Errorf("%s: received status %d for an unknown device, expected %d", endpoint, recorder.Code, http.StatusNotFound)
+			}
+		}
+		if device := a.Store.GetDevice("aabbccddeeff"); device != nil {
+			t.Errorf("received stored device %+v, expected none", device)
+		}
+	})
+}
+
+func TestSensorTypes(t *testing.T) {
+	_, router := newTestAPI(t)
+	path := "/v1/smart_devices/" + testMacAddress
+	body := []byte(`{"timestamp":1600000100,"readings":[[1600000000,1,1234],[1600000000,10,1],[1600000000,6,1500],[1600000000,4113,3]]}`)
+	deviceRequest(t, router, http.MethodPost, path+"/readings", testKey, body)
+
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/v1/sensors", nil))
+	var types []model.SensorType
+	if err := json.Unmarshal(recorder.Body.Bytes(), &types); err != nil {
+		t.Fatalf("decoding response resulted in error: %s", err)
+	}
+	names := make([]string, 0)
+	for _, sensorType := range types {
+		names = append(names, sensorType.Name)
+		if sensorType.Name == model.Temperature && (sensorType.Unit != "°C" || fmt.Sprint(sensorType.Codes) != "[7 15]") {
+			t.Errorf("received %+v, expected unit °C and codes 7 and 15", sensorType)
+		}
+	}
+	expected := "[battery_voltage board_temperature button light rssi soil_moisture soil_sensors_trigger soil_temperature temperature]"
+	if fmt.Sprint(names) != expected {
+		t.Errorf("received sensor types %v, expected %s", names, expected)
+	}
+
+	// every listed type is queryable, diagnostics are not
+	for sensor, value := range map[string]float64{model.BoardTemperature: 1234, model.SoilSensorsTrigger: 1, model.Button: 1.5} {
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, path+"/sensors/"+sensor+"?from=0", nil))
+		var data []model.ChartData
+		if err := json.Unmarshal(recorder.Body.Bytes(), &data); err != nil || len(data) != 1 || data[0].Y != value {
+			t.Errorf("%s: received %s, expected a single point of %g", sensor, recorder.Body.String(), value)
+		}
+	}
+	recorder = httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, path+"/sensors/wifi_reconnect_count", nil))
+	if recorder.Code != http.StatusNotFound {
+		t.Errorf("received status %d for a diagnostic, expected %d", recorder.Code, http.StatusNotFound)
+	}
+}
+
+func TestDeviceManagement(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, a *API, router *gin.Engine) {
+		path := "/v1/smart_devices/" + testMacAddress
+		request := func(method, path, body string) *httptest.ResponseRecorder {
+			recorder := httptest.NewRecorder()
+			router.ServeHTTP(recorder, httptest.NewRequest(method, path, strings.NewReader(body)))
+			return recorder
+		}
+
+		// the board of the pot was swapped, the history is stored under the old mac address
+		const oldMacAddress = "aabbccddeeff"
+		data, _ := parseReadings([]byte(`{"timestamp":1600003700,"readings":[[1600000000,11,22.5],[1600003600,11,23.5],[1600000000,6,1500]]}`))
+		if err := a.ingestReadings(oldMacAddress, config.Device{Name: "old pot"}, data, false); err != nil {
+			t.Fatalf("storing readings resulted in error: %s", err)
+		}
+		deviceRequest(t, router, http.MethodPost, path+"/readings", testKey, []byte(`{"timestamp":1600007300,"readings":[[1600003600,11,24.5],[1600007200,11,25.5]]}`))
+
+		if recorder := request(http.MethodPatch, "/v1/smart_devices/"+oldMacAddress, `{"notes":"repotted in may","location":"kitchen"}`); recorder.Code != http.StatusOK {
+			t.Errorf("received status %d, expected %d", recorder.Code, http.StatusOK)
+		}
+		if recorder := request(http.MethodPatch, "/v1/smart_devices/665544332211", `{"name":"unknown"}`); recorder.Code != http.StatusNotFound {
+			t.Errorf("received status %d for an unknown device, expected %d", recorder.Code, http.StatusNotFound)
+		}
+		if recorder := request(http.MethodPost, path+"/merge", `{"macAddress":"`+testMacAddress+`"}`); recorder.Code != http.StatusBadRequest {
+			t.Errorf("received status %d merging a device into itself, expected %d", recorder.Code, http.StatusBadRequest)
+		}
+
+		recorder := request(http.MethodPost, path+"/merge", `{"macAddress":"`+oldMacAddress+`"}`)
+		var device model.Device
+		if err := json.Unmarshal(recorder.Body.Bytes(), &device); err != nil || device.Name != "pot" || device.Location != "kitchen" || device.Notes != "repotted in may" {
+			t.Errorf("received %s, expected the pot with the notes and location of the old device", recorder.Body.String())
+		}
+		if a.Store.GetDevice(oldMacAddress) != nil {
+			t.Errorf("merged device still exists")
+		}
+
+		// the readings of the new device win over those of the same time
+		recorder = request(http.MethodGet, path+"/sensors/soil_temperature?from=0", "")
+		var points []model.ChartData
+		json.Unmarshal(recorder.Body.Bytes(), &points)
+		values := make([]float64, 0)
+		for _, point := range points {
+			values = append(values, point.Y)
+		}
+		if fmt.Sprint(values) != "[20 22 23]" {
+			t.Errorf("received %v, expected [20 22 23]", values)
+		}
+		if recorder := request(http.MethodGet, path+"/sensors/button?from=0", ""); !strings.Contains(recorder.Body.String(), `"y":1.5`) {
+			t.Errorf("received %s, expected the button press of the old device", recorder.Body.String())
+		}
+
+		if recorder := request(http.MethodPatch, path, `{"name":"basil"}`); recorder.Code != http.StatusOK {
+			t.Errorf("received status %d, expected %d", recorder.Code, http.StatusOK)
+		}
+		recorder = request(http.MethodGet, path+"/status", "")
+		var status model.DeviceStatus
+		if err := json.Unmarshal(recorder.Body.Bytes(), &status); err != nil || status.Name != "basil" {
+			t.Errorf("received %s, expected the new name", recorder.Body.String())
+		}
+
+		if recorder := request(http.MethodDelete, path, ""); recorder.Code != http.StatusNoContent {
+			t.Errorf("received status %d, expected %d", recorder.Code, http.StatusNoContent)
+		}
+		for query, expected := range map[string]string{"": "[]", "?status=true": "[]"} {
+			if recorder := request(http.MethodGet, "/v1/smart_devices"+query, ""); recorder.Body.String() != expected {
+				t.Errorf("%s: received %s, expected %s after deleting", query, recorder.Body.String(), expected)
+			}
+		}
+		recorder = request(http.MethodGet, "/v1/smart_devices?deleted=true", "")
+		var devices []model.Device
+		if err := json.Unmarshal(recorder.Body.Bytes(), &devices); err != nil || len(devices) != 1 || devices[0].Deleted == nil {
+			t.Errorf("received %s, expected the deleted device", recorder.Body.String())
+		}
+
+		// a deleted device is gone unless asked for, its readings are still stored
+		for _, endpoint := range []string{"/status", "/info", "/sensors/soil_temperature?from=0"} {
+			if recorder := request(http.MethodGet, path+endpoint, ""); recorder.Code != http.StatusGone {
+				t.Errorf("%s: received status %d, expected %d after deleting", endpoint, recorder.Code, http.StatusGone)
+			}
+		}
+		if recorder := request(http.MethodGet, path+"/status?deleted=true", ""); recorder.Code != http.StatusOK {
+			t.Errorf("received status %d, expected %d with deleted=true", recorder.Code, http.StatusOK)
+		}
+		a.Store.SetLastSeen(testMacAddress, config.Device{}, 1)
+		if recorder, _ := deviceRequest(t, router, http.MethodPost, path+"/readings", testKey, []byte(`{"timestamp":1600010900,"readings":[[1600010800,11,26.5]]}`)); recorder.Code != http.StatusCreated {
+			t.Errorf("received status %d posting readings of a deleted device, expected %d", recorder.Code, http.StatusCreated)
+		}
+		if stored := a.Store.GetDevice(testMacAddress); stored.LastSeen == 1 || stored.Deleted == 0 {
+			t.Errorf("received last seen %d and deleted %d, expected the device seen and still deleted", stored.LastSeen, stored.Deleted)
+		}
+		recorder = request(http.MethodGet, path+"/sensors/soil_temperature?from=0&deleted=true", "")
+		if strings.Count(recorder.Body.String(), `"y"`) != 4 {
+			t.Errorf("received %s, expected the reading sent while deleted", recorder.Body.String())
+		}
+
+		request(http.MethodPatch, path, `{"deleted":false}`)
+		recorder = request(http.MethodGet, "/v1/smart_devices", "")
+		devices = nil
+		if err := json.Unmarshal(recorder.Body.Bytes(), &devices); err != nil || len(devices) != 1 || devices[0].Deleted != nil || devices[0].Name != "basil" {
+			t.Errorf("received %s, expected the restored device", recorder.Body.String())
+		}
+	})
+}
+
+func TestPlantProfile(t *testing.T) {
+	a, router := newTestAPI(t)
+	path := "/v1/smart_devices/" + testMacAddress
+
+	min, max := 2.0, 3.0
+	a.Plants.Add(map[string]config.PlantProfile{
+		"fern": {Species: "Nephrolepis", Moisture: config.Range{Min: &min, Max: &max}, Light: config.Range{Min: &min}},
+	})
+	device, _ := a.Config.Device(testMacAddress)
+	device.Plant = "fern"
+	a.Config.SetDevice(testMacAddress, device)
+
+	// soil moisture of about 1.4, 2.4 and 3.8, no light in the night
+	body := []byte(`{"timestamp":1600007300,"readings":[[1600000000,12,4500],[1600003600,12,6500],[1600007200,12,8778.25],[1600007200,8,0]]}`)
+	deviceRequest(t, router, http.MethodPost, path+"/readings", testKey, body)
+
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, path+"/sensors/soil_moisture?from=0", nil))
+	var data []model.ChartData
+	json.Unmarshal(recorder.Body.Bytes(), &data)
+	verdicts := make([]string, 0)
+	for _, point := range data {
+		verdicts = append(verdicts, point.Verdict)
+	}
+	if fmt.Sprint(verdicts) != "[too_dry ok too_wet]" {
+		t.Errorf("received verdicts %v, expected [too_dry ok too_wet]", verdicts)
+	}
+
+	recorder = httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, path+"/status", nil))
+	var status model.DeviceStatus
+	if err := json.Unmarshal(recorder.Body.Bytes(), &status); err != nil {
+		t.Fatalf("decoding response resulted in error: %s", err)
+	}
+	if status.Plant == nil || status.Plant.Id != "fern" || status.Plant.Species != "Nephrolepis" {
+		t.Errorf("received plant %+v, expected the fern", status.Plant)
+	}
+	if value := status.Sensors[model.SoilMoisture]; value == nil || value.Verdict != model.VerdictTooWet {
+		t.Errorf("received soil moisture %+v, expected %s", value, model.VerdictTooWet)
+	}
+	if value := status.Sensors[model.Light]; value == nil || value.Verdict != "" {
+		t.Errorf("received light %+v, expected no verdict in the night", value)
+	}
+	if status.Health != model.HealthWarning || fmt.Sprint(status.Problems) != "[too_wet]" {
+		t.Errorf("received health %s %v, expected %s [too_wet]", status.Health, status.Problems, model.HealthWarning)
+	}
+
+	recorder = httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/v1/plants", nil))
+	var plants []model.Plant
+	json.Unmarshal(recorder.Body.Bytes(), &plants)
+	found := false
+	for _, plant := range plants {
+		found = found || plant.Id == "fern"
+	}
+	if !found {
+		t.Errorf("received %s, expected the custom plant", recorder.Body.String())
+	}
+}
+
+func TestAlerts(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, a *API, router *gin.Engine) {
+		path := "/v1/smart_devices/" + testMacAddress
+		request := func(method, path string) *httptest.ResponseRecorder {
+			recorder := httptest.NewRecorder()
+			router.ServeHTTP(recorder, httptest.NewRequest(method, path, nil))
+			return recorder
+		}
+
+		a.Config.Alerts = config.Alerts{
+			Rules:    []config.Rule{{Name: "cold", Condition: "soil_temperature < 18"}},
+			Channels: map[string]config.Channel{"log": {Type: model.ChannelLog}},
+		}
+		a.Alerts = alerts.New(a.Config, a.Store)
+		device, _ := a.Config.Device(testMacAddress)
+		device.ButtonActions = []config.Action{{Type: model.ActionAcknowledge}}
+		a.Config.SetDevice(testMacAddress, device)
+
+		// soil temperature of 17.5
+		deviceRequest(t, router, http.MethodPost, path+"/readings", testKey, []byte(`{"timestamp":1600000010,"readings":[[1600000000,11,20]]}`))
+		var data []model.Alert
+		json.Unmarshal(request(http.MethodGet, "/v1/alerts?active=true").Body.Bytes(), &data)
+		if len(data) != 1 || data[0].State != model.AlertFiring || data[0].MacAddress != testMacAddress || data[0].Value != 17.5 {
+			t.Fatalf("received alerts %+v, expected a firing alert", data)
+		}
+		id := fmt.Sprint(data[0].Id)
+
+		// the button acknowledges the alerts of the device
+		deviceRequest(t, router, http.MethodPost, path+"/readings", testKey, []byte(`{"timestamp":1600000110,"readings":[[1600000100,6,1500]]}`))
+		data = nil
+		json.Unmarshal(request(http.MethodGet, "/v1/alerts?device="+testMacAddress).Body.Bytes(), &data)
+		if len(data) != 1 || data[0].State != model.AlertAcknowledged || data[0].Acknowledged == nil {
+			t.Errorf("received alerts %+v, expected an acknowledged alert", data)
+		}
+
+		if recorder := request(http.MethodPost, "/v1/alerts/"+id+"/resolve"); recorder.Code != http.StatusOK {
+			t.Errorf("received status %d, expected %d", recorder.Code, http.StatusOK)
+		}
+		if recorder := request(http.MethodPost, "/v1/alerts/"+id+"/resolve"); recorder.Code != http.StatusConflict {
+			t.Errorf("received status %d, expected %d", recorder.Code, http.StatusConflict)
+		}
+		if recorder := request(http.MethodPost, "/v1/alerts/abc/acknowledge"); recorder.Code != http.StatusNotFound {
+			t.Errorf("received status %d, expected %d", recorder.Code, http.StatusNotFound)
+		}
+		if recorder := request(http.MethodGet, "/v1/alerts?device=665544332211"); recorder.Code != http.StatusNotFound {
+			t.Errorf("received status %d, expected %d", recorder.Code, http.StatusNotFound)
+		}
+		data = nil
+		json.Unmarshal(request(http.MethodGet, "/v1/alerts?active=true").Body.Bytes(), &data)
+		if len(data) != 0 {
+			t.Errorf("received %d active alerts, expected none", len(data))
+		}
+
+		// readings buffered until a device is adopted are history and raise no alerts
+		const pendingMacAddress = "aabbccddeeff"
+		deviceRequest(t, router, http.MethodPost, "/v1/smart_devices/"+pendingMacAddress+"/readings", testKey, []byte(`{"timestamp":1600000010,"readings":[[1600000000,11,20]]}`))
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/v1/pending_devices/"+pendingMacAddress, strings.NewReader(`{"name":"new pot","key":"`+testKey+`"}`)))
+		if recorder.Code != http.StatusOK {
+			t.Errorf("received status %d adopting a device, expected %d", recorder.Code, http.StatusOK)
+		}
+		data = nil
+		json.Unmarshal(request(http.MethodGet, "/v1/alerts?device="+pendingMacAddress).Body.Bytes(), &data)
+		if len(data) != 0 {
+			t.Errorf("received alerts %+v, expected none for the readings of an adopted device", data)
+		}
+
+		var rules []model.AlertRule
+		json.Unmarshal(request(http.MethodGet, "/v1/alert_rules").Body.Bytes(), &rules)
+		if len(rules) != 1 || rules[0].Sensor != model.SoilTemperature || rules[0].Operator != "<" || rules[0].Threshold != 18 {
+			t.Errorf("received rules %+v, expected the cold rule", rules)
+		}
+	})
+}
+
+func TestReprocess(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, a *API, router *gin.Engine) {
+		path := "/v1/smart_devices/" + testMacAddress
+		const newKey = "ffeeddccbbaa99887766554433221100"
+		a.Config.Output.Archive = true
+		soilMoisture := func() string {
+			recorder := httptest.NewRecorder()
+			router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, path+"/sensors/soil_moisture?from=0", nil))
+			var points []model.ChartData
+			json.Unmarshal(recorder.Body.Bytes(), &points)
+			values := make([]float64, 0)
+			for _, point := range points {
+				values = append(values, point.Y)
+			}
+			return fmt.Sprint(values)
+		}
+
+		deviceRequest(t, router, http.MethodPost, path+"/readings", testKey, readingsBody(1600000000, 600, 12, 6500))
+		before := soilMoisture()
+		// a cold soil and a button press sent with a key the server does not know yet
+		if recorder, _ := deviceRequest(t, router, http.MethodPost, path+"/readings", newKey, []byte(`{"timestamp":1600003700,"readings":[[1600003600,11,20],[1600003600,6,1500]]}`)); recorder.Code != http.StatusUnauthorized {
+			t.Errorf("received status %d, expected %d for an unknown key", recorder.Code, http.StatusUnauthorized)
+		}
+
+		// the key and the calibration are fixed, alerts and actions are configured since
+		a.Config.Alerts = config.Alerts{
+			Rules:    []config.Rule{{Name: "cold", Condition: "soil_temperature < 18"}},
+			Channels: map[string]config.Channel{"log": {Type: model.ChannelLog}},
+		}
+		a.Alerts = alerts.New(a.Config, a.Store)
+		device, _ := a.Config.Device(testMacAddress)
+		device.Key = newKey
+		device.CalibrationParameters.MoistureMin = 4500
+		device.ButtonActions = []config.Action{{Type: model.ActionWatered}}
+		a.Config.SetDevice(testMacAddress, device)
+
+		processed, err := a.Reprocess(testMacAddress)
+		if err != nil || processed != 2 {
+			t.Fatalf("received %d processed payloads and error %v, expected 2", processed, err)
+		}
+		if after := soilMoisture(); after == before || after == "[]" {
+			t.Errorf("received soil moisture %s, expected it converted with the new calibration instead of %s", after, before)
+		}
+		deviceId := a.Store.GetDeviceId(testMacAddress, device)
+		if event := a.Store.GetLatestEvent(deviceId, model.EventButton); event == nil || event.Duration != 1.5 {
+			t.Errorf("received button event %+v, expected the press decrypted with the new key", event)
+		}
+
+		// replayed history raises no alerts and runs no actions
+		if event := a.Store.GetLatestEvent(deviceId, model.EventWatered); event != nil {
+			t.Errorf("received watered event %+v, expected the button action not to run", event)
+		}
+		if alert := a.Store.GetLatestAlert(deviceId, "cold"); alert != nil {
+			t.Errorf("received alert %+v, expected none for reprocessed readings", alert)
+		}
+	})
+}
+
+func TestRecalibrate(t *testing.T) {
+	a, router := newTestAPI(t)
+	path := "/v1/smart_devices/" + testMacAddress
+	request := func(method, path, body string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest(method, path, strings.NewReader(body)))
+		return recorder
+	}
+	recalibrate := func(body string) model.RecalibrationResult {
+		recorder := request(http.MethodPost, path+"/recalibrate", body)
+		var result model.RecalibrationResult
+		if err := json.Unmarshal(recorder.Body.Bytes(), &result); err != nil || recorder.Code != http.StatusOK {
+			t.Fatalf("received status %d %s, expected a recalibration result", recorder.Code, recorder.Body.String())
+		}
+		return result
+	}
+
+	// soil moisture an hour apart and a temperature stored before its code
+	// was recorded, ambiguous between codes 7 and 15
+	deviceRequest(t, router, http.MethodPost, path+"/readings", testKey, readingsBody(1600000000, 3600, 12, 4500, 6500))
+	device, _ := a.Config.Device(testMacAddress)
+	deviceId := a.Store.GetDeviceId(testMacAddress, device)
+	if _, err := client(a).Exec("insert into readings (device, rawvalue, convertedvalue, timestamp, sensor) values ($1, 1, 1, 1600000000, $2)", deviceId, a.Store.GetSensorId(model.Temperature)); err != nil {
+		t.Fatalf("storing reading resulted in error: %s", err)
+	}
+	convert := sensors.GetSensors()[12].ConversionFunc
+	soilMoisture := func() ([]float64, []int64) {
+		values, calibrations := make([]float64, 0), make([]int64, 0)
+		for _, reading := range a.Store.GetRawReadings(deviceId, 0, 1700000000) {
+			if reading.Code == 12 {
+				values = append(values, reading.ConvertedValue)
+				calibrations = append(calibrations, reading.CalibrationId)
+			}
+		}
+		return values, calibrations
+	}
+
+	explicit := config.CalibrationParameters{SmuGain: 1, MoistureContinuity: 8700, MoistureMin: 3400}
+	result := recalibrate(`{"calibrationParameters":{"RN171_SMU_GAIN":1,"SOIL_MOISTURE_DISCONTINUITY":8700,"SOIL_MOISTURE_MIN":3400}}`)
+	if result.Updated != 2 || result.Skipped != 1 || len(result.Calibrations) != 1 {
+		t.Errorf("received %+v, expected 2 readings updated with one calibration and 1 skipped", result)
+	}
+	oneOff := result.Calibrations[0]
+	values, calibrations := soilMoisture()
+	if expected := fmt.Sprint([]float64{convert(4500, explicit), convert(6500, explicit)}); fmt.Sprint(values) != expected {
+		t.Errorf("received %v, expected %s", values, expected)
+	}
+	if fmt.Sprint(calibrations) != fmt.Sprint([]int64{oneOff, oneOff}) {
+		t.Errorf("received calibrations %v, expected %d", calibrations, oneOff)
+	}
+
+	// the current parameters replaced older ones between the readings
+	historical := config.CalibrationParameters{SmuGain: 1, MoistureContinuity: 8000, MoistureMin: 3000}
+	device.CalibrationHistory = []config.CalibrationSet{{EffectiveFrom: time.Unix(1500000000, 0), CalibrationParameters: historical}}
+	device.CalibrationEffectiveFrom = time.Unix(1600001800, 0)
+	a.Config.SetDevice(testMacAddress, device)
+
+	result = recalibrate(`{}`)
+	if result.Updated != 2 || result.Skipped != 1 || len(result.Calibrations) != 2 {
+		t.Errorf("received %+v, expected 2 readings updated with two calibrations and 1 skipped", result)
+	}
+	values, calibrations = soilMoisture()
+	if expected := fmt.Sprint([]float64{convert(4500, historical), convert(6500, device.CalibrationParameters)}); fmt.Sprint(values) != expected {
+		t.Errorf("received %v, expected %s", values, expected)
+	}
+	if fmt.Sprint(calibrations) != fmt.Sprint(result.Calibrations) {
+		t.Errorf("received calibrations %v, expected %v", calibrations, result.Calibrations)
+	}
+
+	if recorder := request(http.MethodPost, "/v1/smart_devices/665544332211/recalibrate", `{}`); recorder.Code != http.StatusNotFound {
+		t.Errorf("received status %d for an unknown device, expected %d", recorder.Code, http.StatusNotFound)
+	}
+
+	// the parameters given to the first recalibration are listed as one-off
+	var listed []model.Calibration
+	json.Unmarshal(request(http.MethodGet, path+"/calibrations", "").Body.Bytes(), &listed)
+	oneOffs := map[int64]bool{}
+	for _, calibration := range listed {
+		oneOffs[calibration.Id] = calibration.OneOff
+	}
+	if listedOneOff, found := oneOffs[oneOff]; !found || !listedOneOff {
+		t.Errorf("received calibrations %+v, expected %d as one-off", listed, oneOff)
+	}
+	for _, id := range result.Calibrations {
+		if listedOneOff, found := oneOffs[id]; !found || listedOneOff {
+			t.Errorf("received calibrations %+v, expected configured calibration %d", listed, id)
+		}
+	}
+}
+
+func TestCalibrations(t *testing.T) {
+	a, router := newTestAPI(t)
+	may := time.Date(2020, 5, 1, 0, 0, 0, 0, time.UTC)
+	july := time.Date(2020, 7, 1, 0, 0, 0, 0, time.UTC)
+	device, _ := a.Config.Device(testMacAddress)
+	device.CalibrationEffectiveFrom = july
+	device.CalibrationHistory = []config.CalibrationSet{{EffectiveFrom: may, CalibrationParameters: config.CalibrationParameters{MoistureMin: 3400}}}
+	a.Config.SetDevice(testMacAddress, device)
+	a.storeCalibrations()
+
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/v1/smart_devices/"+testMacAddress+"/calibrations", nil))
+	var calibrations []model.Calibration
+	if err := json.Unmarshal(recorder.Body.Bytes(), &calibrations); err != nil {
+		t.Fatalf("decoding response resulted in error: %s", err)
+	}
+
+	// the sets are ordered by the time they became effective, the set stored
+	// by New before the history was configured is no longer configured
+	received := make([]string, 0)
+	for _, calibration := range calibrations {
+		effectiveFrom := "-"
+		if calibration.EffectiveFrom != nil {
+			effectiveFrom = calibration.EffectiveFrom.UTC().Format("2006-01-02")
+		}
+		received = append(received, fmt.Sprintf("%s %g %t", effectiveFrom, calibration.CalibrationParameters.MoistureMin, calibration.OneOff))
+	}
+	expected := "[- 3515.25 true 2020-05-01 3400 false 2020-07-01 3515.25 false]"
+	if fmt.Sprint(received) != expected {
+		t.Errorf("received %v, expected %s", received, expected)
+	}
+}
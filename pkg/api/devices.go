@@ -0,0 +1,185 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"koubachi-goserver/pkg/config"
+	"koubachi-goserver/pkg/model"
+	"koubachi-goserver/pkg/storage"
+)
+
+var ErrSameDevice = errors.New("cannot merge a device into itself")
+
+// UpdateDevice changes the name, notes, location or deletion of a device. The
+// name in the configuration is only used for devices not stored yet, a
+// renamed device keeps the name given here.
+func (api *API) UpdateDevice(macAddress string, update model.DeviceUpdate) (*model.Device, error) {
+	device := api.storedDevice(macAddress)
+	if device == nil {
+		return nil, ErrUnknownDevice
+	}
+
+	if update.Name != nil {
+		device.Name = *update.Name
+	}
+	if update.Notes != nil {
+		device.Notes = *update.Notes
+	}
+	if update.Location != nil {
+		device.Location = *update.Location
+	}
+	if update.Deleted != nil {
+		switch {
+		case !*update.Deleted:
+			device.Deleted = 0
+		case device.Deleted == 0:
+			device.Deleted = time.Now().Unix()
+		}
+	}
+
+	if err := api.Store.UpdateDevice(device); err != nil {
+		return nil, err
+	}
+	data := deviceData(device)
+	return &data, nil
+}
+
+// DeleteDevice hides a device from the device list and statuses, its history
+// is kept and it is restored with UpdateDevice.
+func (api *API) DeleteDevice(macAddress string) error {
+	deleted := true
+	_, err := api.UpdateDevice(macAddress, model.DeviceUpdate{Deleted: &deleted})
+	return err
+}
+
+// MergeDevices moves the readings, diagnostics, events, announcements and
+// calibrations of a device to another one and removes it, e.g. after a board
+// swap changed the mac address of a sensor.
+func (api *API) MergeDevices(sourceMacAddress, targetMacAddress string) (*model.Device, error) {
+	if sourceMacAddress == targetMacAddress {
+		return nil, ErrSameDevice
+	}
+	source := api.Store.GetDevice(sourceMacAddress)
+	target := api.storedDevice(targetMacAddress)
+	if source == nil || target == nil {
+		return nil, ErrUnknownDevice
+	}
+
+	if err := api.Store.MergeDevices(source.Id, target.Id); err != nil {
+		return nil, err
+	}
+	data := deviceData(api.Store.GetDevice(targetMacAddress))
+	return &data, nil
+}
+
+// storedDevice returns a stored device, configured devices are stored if they
+// did not send anything yet. It is nil for unknown devices.
+func (api *API) storedDevice(macAddress string) *storage.Device {
+	if device := api.Store.GetDevice(macAddress); device != nil {
+		return device
+	}
+	device, found := api.Config.Device(macAddress)
+	if !found {
+		return nil
+	}
+	api.Store.GetDeviceId(macAddress, device)
+	return api.Store.GetDevice(macAddress)
+}
+
+// lookupDevice returns the configuration and stored id of the device of a read
+// request without storing it, the id is 0 for a configured device that did not
+// send anything yet. Unknown devices are answered with 404 and ok is false.
+func (api *API) lookupDevice(c *gin.Context) (macAddress string, device config.Device, deviceId int64, ok bool) {
+	macAddress = c.Param("macAddress")
+	device, configured := api.Config.Device(macAddress)
+	stored := api.Store.GetDevice(macAddress)
+	if stored == nil && !configured {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "unknown device"})
+		return macAddress, device, 0, false
+	}
+	if stored != nil {
+		deviceId = stored.Id
+	}
+	return macAddress, device, deviceId, true
+}
+
+func deviceData(device *storage.Device) model.Device {
+	data := model.Device{
+		Id:         device.Id,
+		MacAddress: device.MacAddress,
+		Name:       device.Name,
+		Notes:      device.Notes,
+		Location:   device.Location,
+	}
+	if device.Deleted > 0 {
+		deleted := time.Unix(device.Deleted, 0)
+		data.Deleted = &deleted
+	}
+	return data
+}
+
+func (api *API) patchDevice(c *gin.Context) {
+	update := model.DeviceUpdate{}
+	if err := c.ShouldBindJSON(&update); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	data, err := api.UpdateDevice(c.Param("macAddress"), update)
+	if err != nil {
+		c.AbortWithStatusJSON(deviceErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, data)
+}
+
+func (api *API) deleteDevice(c *gin.Context) {
+	if err := api.DeleteDevice(c.Param("macAddress")); err != nil {
+		c.AbortWithStatusJSON(deviceErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// postMerge merges the device in the body into the device of the path.
+func (api *API) postMerge(c *gin.Context) {
+	merge := model.DeviceMerge{}
+	if err := c.ShouldBindJSON(&merge); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	data, err := api.MergeDevices(merge.MacAddress, c.Param("macAddress"))
+	if err != nil {
+		c.AbortWithStatusJSON(deviceErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, data)
+}
+
+// hideDeleted ends requests for a deleted device with 410 Gone, unless they
+// ask for deleted devices with ?deleted=true like the device list does.
+func (api *API) hideDeleted(c *gin.Context) {
+	if c.Query("deleted") == "true" {
+		return
+	}
+	if device := api.Store.GetDevice(c.Param("macAddress")); device != nil && device.Deleted > 0 {
+		c.AbortWithStatusJSON(http.StatusGone, gin.H{"error": "deleted device"})
+	}
+}
+
+func deviceErrorStatus(err error) int {
+	switch err {
+	case ErrUnknownDevice:
+		return http.StatusNotFound
+	case ErrSameDevice:
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
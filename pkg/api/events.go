@@ -0,0 +1,113 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"koubachi-goserver/pkg/config"
+	"koubachi-goserver/pkg/model"
+	"koubachi-goserver/pkg/sensors"
+	"koubachi-goserver/pkg/storage"
+)
+
+const webhookTimeout = 10 * time.Second
+
+func (api *API) getEvents(c *gin.Context) {
+	macAddress, _, deviceId, ok := api.lookupDevice(c)
+	if !ok {
+		return
+	}
+	events := api.Store.GetEvents(deviceId, 14)
+
+	data := make([]model.Event, 0)
+	for _, event := range events {
+		data = append(data, model.Event{
+			MacAddress: macAddress,
+			Type:       event.Type,
+			Duration:   event.Duration,
+			Timestamp:  time.Unix(event.Timestamp, 0),
+		})
+	}
+
+	c.JSON(http.StatusOK, data)
+}
+
+// getEventReadings answers a readings request of an event type like the
+// button with the duration of the events as values.
+func (api *API) getEventReadings(c *gin.Context, deviceId int64, eventType string, query storage.ReadingQuery) {
+	if query.Step > 0 {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "events cannot be averaged"})
+		return
+	}
+
+	days := int(time.Since(time.Unix(query.From, 0)).Hours()/24) + 1
+	data := make([]model.ChartData, 0)
+	for _, event := range api.Store.GetEvents(deviceId, days) {
+		if event.Type != eventType || event.Timestamp < query.From || event.Timestamp > query.To {
+			continue
+		}
+		data = append(data, model.ChartData{
+			T: time.Unix(event.Timestamp, 0),
+			Y: event.Duration,
+		})
+	}
+
+	if query.Descending {
+		for i, j := 0, len(data)-1; i < j; i, j = i+1, j-1 {
+			data[i], data[j] = data[j], data[i]
+		}
+	}
+	if query.Limit > 0 && len(data) > query.Limit {
+		data = data[:query.Limit]
+	}
+	c.JSON(http.StatusOK, data)
+}
+
+// buttonPressed runs the configured button actions of a device.
+func (api *API) buttonPressed(macAddress string, device config.Device, reading *sensors.Reading) {
+	event := model.Event{
+		MacAddress: macAddress,
+		Type:       model.EventButton,
+		Duration:   reading.ConvertedValue,
+		Timestamp:  time.Unix(int64(reading.Timestamp), 0),
+	}
+
+	for _, action := range device.ButtonActions {
+		switch action.Type {
+		case model.ActionWebhook:
+			go sendWebhook(action.URL, event)
+		case model.ActionWatered:
+			api.Store.WriteEvent(macAddress, model.EventWatered, 0, int64(reading.Timestamp), device)
+		case model.ActionAcknowledge:
+			api.Store.WriteEvent(macAddress, model.EventAcknowledged, 0, int64(reading.Timestamp), device)
+			api.Alerts.AcknowledgeDevice(api.Store.GetDeviceId(macAddress, device))
+		default:
+			log.Printf("error: unknown button action %q of device %s", action.Type, macAddress)
+		}
+	}
+}
+
+// sendWebhook posts the event as json to the url.
+func sendWebhook(url string, event model.Event) {
+	body, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("error: encoding webhook for %s failed: %v", event.MacAddress, err)
+		return
+	}
+
+	client := http.Client{Timeout: webhookTimeout}
+	response, err := client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		log.Printf("error: webhook %s for %s failed: %v", url, event.MacAddress, err)
+		return
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode >= http.StatusBadRequest {
+		log.Printf("error: webhook %s for %s returned %s", url, event.MacAddress, response.Status)
+	}
+}
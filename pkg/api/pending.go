@@ -0,0 +1,147 @@
+package api
+
+import (
+	"log"
+	"net/http"
+	"regexp"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"koubachi-goserver/pkg/config"
+	"koubachi-goserver/pkg/model"
+)
+
+// payloads of unknown devices are kept up to this size, the largest batch of
+// readings a sensor sends is a few kilobytes
+const maxPendingPayloadSize = 64 << 10
+
+// defaultPendingLimit is the number of payloads kept per unknown device, about
+// six weeks of hourly transmissions
+const defaultPendingLimit = 1000
+
+var macAddressPattern = regexp.MustCompile(`^[0-9a-fA-F]{12}$`)
+
+// keepPending keeps the payload of a request from an unknown device and
+// answers it with 404. Only payloads of a plausible size sent to a valid mac
+// address are kept, the oldest beyond the pending limit are dropped.
+func (api *API) keepPending(c *gin.Context, macAddress, endpoint string, payload []byte) {
+	switch {
+	case !macAddressPattern.MatchString(macAddress):
+		log.Printf("error: request for invalid mac address %q", macAddress)
+		c.AbortWithStatus(http.StatusBadRequest)
+	case len(payload) > maxPendingPayloadSize:
+		log.Printf("error: request from unknown device %s with %d bytes, payload dropped", macAddress, len(payload))
+		c.AbortWithStatus(http.StatusRequestEntityTooLarge)
+	default:
+		log.Printf("error: request from unknown device %s, payload kept as pending", macAddress)
+		limit := api.Config.Output.PendingLimit
+		if limit <= 0 {
+			limit = defaultPendingLimit
+		}
+		api.Store.WritePendingPayload(macAddress, endpoint, payload, limit)
+		c.AbortWithStatus(http.StatusNotFound)
+	}
+}
+
+func (api *API) getPendingDevices(c *gin.Context) {
+	payloads := api.Store.GetPendingPayloads("")
+
+	data := make([]model.PendingDevice, 0)
+	index := map[string]int{}
+	for _, payload := range payloads {
+		timestamp := time.Unix(payload.Timestamp, 0)
+
+		i, ok := index[payload.MacAddress]
+		if !ok {
+			index[payload.MacAddress] = len(data)
+			data = append(data, model.PendingDevice{
+				MacAddress: payload.MacAddress,
+				FirstSeen:  timestamp,
+			})
+			i = len(data) - 1
+		}
+		data[i].Payloads++
+		data[i].LastSeen = timestamp
+	}
+
+	c.JSON(http.StatusOK, data)
+}
+
+// adoptPendingDevice adds an unknown device with the given key to the
+// configuration and imports its buffered readings.
+func (api *API) adoptPendingDevice(c *gin.Context) {
+	macAddress := c.Param("macAddress")
+
+	adoption := model.PendingDeviceAdoption{}
+	if err := c.ShouldBindJSON(&adoption); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if _, found := api.Config.Device(macAddress); found {
+		c.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": "device is already configured"})
+		return
+	}
+
+	payloads := api.Store.GetPendingPayloads(macAddress)
+	if len(payloads) == 0 {
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+
+	// verify the key against every payload before changing anything
+	device := config.Device{
+		Name: adoption.Name,
+		Key:  adoption.Key,
+	}
+	bodies := make([][]byte, len(payloads))
+	for i, payload := range payloads {
+		_, body, _, err := decrypt(device, payload.Payload)
+		if err != nil {
+			c.AbortWithStatusJSON(errorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+		bodies[i] = body
+	}
+
+	// importing again is harmless, a failed adoption can simply be retried
+	imported := 0
+	for i, payload := range payloads {
+		if payload.Endpoint != EndpointReadings {
+			continue
+		}
+		data, err := parseReadings(bodies[i])
+		if err != nil {
+			log.Printf("error: invalid pending readings from %s: %v", macAddress, err)
+			continue
+		}
+		// the readings may be weeks old, they raise no alerts
+		if err := api.ingestReadings(macAddress, device, data, true); err != nil {
+			log.Printf("error: storing pending readings from %s failed: %v", macAddress, err)
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		imported++
+	}
+	api.Config.SetDevice(macAddress, device)
+	api.Store.DeletePendingPayloads(macAddress)
+
+	saved := true
+	if err := api.Config.Save(); err != nil {
+		log.Printf("error: saving configuration with device %s failed: %v", macAddress, err)
+		saved = false
+	}
+
+	c.JSON(http.StatusOK, model.PendingDeviceImport{
+		MacAddress: macAddress,
+		Imported:   imported,
+		Saved:      saved,
+	})
+}
+
+func (api *API) deletePendingDevice(c *gin.Context) {
+	macAddress := c.Param("macAddress")
+
+	api.Store.DeletePendingPayloads(macAddress)
+	c.Status(http.StatusNoContent)
+}
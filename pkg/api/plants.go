@@ -0,0 +1,65 @@
+package api
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"koubachi-goserver/pkg/config"
+	"koubachi-goserver/pkg/model"
+	"koubachi-goserver/pkg/plants"
+	"koubachi-goserver/pkg/sensors"
+)
+
+// loadPlants reads the bundled plant catalogue and adds the custom plants of
+// the configuration. Without the catalogue only the custom plants are known.
+func loadPlants(configuration *config.Config) plants.Catalogue {
+	catalogue, err := plants.Load(plants.File)
+	if err != nil {
+		log.Printf("error: loading plant catalogue failed: %v", err)
+		catalogue = plants.Catalogue{}
+	}
+	catalogue.Add(configuration.Plants)
+
+	for _, macAddress := range configuration.MacAddresses() {
+		device, _ := configuration.Device(macAddress)
+		if _, found := catalogue[device.Plant]; device.Plant != "" && !found {
+			log.Printf("warning: unknown plant %q of device %s", device.Plant, macAddress)
+		}
+	}
+	return catalogue
+}
+
+// plant returns the plant profile of a device, nil if it has none.
+func (api *API) plant(device config.Device) *model.Plant {
+	profile, found := api.Plants[device.Plant]
+	if device.Plant == "" || !found {
+		return nil
+	}
+	return &model.Plant{
+		Id:           device.Plant,
+		PlantProfile: profile,
+	}
+}
+
+// judge returns the verdict on a sensor value, empty without a plant profile.
+// Light below the day threshold of the device is night and not judged.
+func judge(plant *model.Plant, settings sensors.Settings, sensorType string, value float64) string {
+	if plant == nil || (sensorType == model.Light && value < settings.DayThreshold) {
+		return ""
+	}
+	return plants.Judge(plant.PlantProfile, sensorType, value)
+}
+
+// getPlants lists the plant profiles devices can refer to.
+func (api *API) getPlants(c *gin.Context) {
+	data := make([]model.Plant, 0)
+	for _, id := range api.Plants.Ids() {
+		data = append(data, model.Plant{
+			Id:           id,
+			PlantProfile: api.Plants[id],
+		})
+	}
+
+	c.JSON(http.StatusOK, data)
+}
@@ -0,0 +1,99 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"koubachi-goserver/pkg/storage"
+)
+
+// time range of the reading endpoints without from and to
+const defaultDays = 14
+
+// readingQuery parses the from, to, limit, order and step query parameters of
+// the reading endpoints. Times are RFC 3339 or unix timestamps, the step is a
+// duration like 1h or a number of seconds.
+func readingQuery(c *gin.Context) (storage.ReadingQuery, error) {
+	query := storage.ReadingQuery{}
+
+	from, to, err := timeRange(c)
+	if err != nil {
+		return query, err
+	}
+	query.From, query.To = from, to
+
+	if value := c.Query("limit"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit < 0 {
+			return query, fmt.Errorf("invalid limit %q", value)
+		}
+		query.Limit = limit
+	}
+
+	switch order := c.DefaultQuery("order", "asc"); order {
+	case "asc":
+	case "desc":
+		query.Descending = true
+	default:
+		return query, fmt.Errorf("invalid order %q, expected asc or desc", order)
+	}
+
+	if value := c.Query("step"); value != "" {
+		step, err := parseStep(value)
+		if err != nil {
+			return query, err
+		}
+		query.Step = step
+	}
+	return query, nil
+}
+
+// timeRange parses the from and to query parameters into unix timestamps.
+func timeRange(c *gin.Context) (int64, int64, error) {
+	to := time.Now()
+	if value := c.Query("to"); value != "" {
+		t, err := parseQueryTime(value)
+		if err != nil {
+			return 0, 0, fmt.Errorf("invalid to: %v", err)
+		}
+		to = t
+	}
+	from := to.AddDate(0, 0, -defaultDays)
+	if value := c.Query("from"); value != "" {
+		t, err := parseQueryTime(value)
+		if err != nil {
+			return 0, 0, fmt.Errorf("invalid from: %v", err)
+		}
+		from = t
+	}
+	if from.After(to) {
+		return 0, 0, errors.New("from is after to")
+	}
+	return from.Unix(), to.Unix(), nil
+}
+
+func parseQueryTime(value string) (time.Time, error) {
+	if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Unix(seconds, 0), nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+// parseStep returns a step in seconds.
+func parseStep(value string) (int64, error) {
+	seconds, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		d, durationErr := time.ParseDuration(value)
+		if durationErr != nil {
+			return 0, fmt.Errorf("invalid step %q", value)
+		}
+		seconds = int64(d / time.Second)
+	}
+	if seconds < 1 {
+		return 0, fmt.Errorf("invalid step %q, expected at least one second", value)
+	}
+	return seconds, nil
+}
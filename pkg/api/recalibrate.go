@@ -0,0 +1,165 @@
+package api
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"koubachi-goserver/pkg/config"
+	"koubachi-goserver/pkg/model"
+	"koubachi-goserver/pkg/sensors"
+	"koubachi-goserver/pkg/storage"
+)
+
+var ErrUnknownDevice = errors.New("unknown device")
+
+// Recalibrate recomputes the converted values of a device within a time range
+// from the raw values. The given calibration parameters are used for all
+// readings or, if nil, the configured set valid when a reading was taken.
+// Readings stored without their sensor code are skipped if the code is
+// ambiguous.
+func (api *API) Recalibrate(macAddress string, from, to time.Time, parameters *config.CalibrationParameters) (*model.RecalibrationResult, error) {
+	device, found := api.Config.Device(macAddress)
+	if !found {
+		return nil, ErrUnknownDevice
+	}
+
+	calibrationAt := device.CalibrationAt
+	if parameters != nil {
+		calibrationAt = func(t time.Time) config.CalibrationSet {
+			return config.CalibrationSet{CalibrationParameters: *parameters}
+		}
+	}
+
+	result := &model.RecalibrationResult{
+		MacAddress:   macAddress,
+		Calibrations: make([]int64, 0),
+	}
+
+	deviceId := api.Store.GetDeviceId(macAddress, device)
+	readings := api.Store.GetRawReadings(deviceId, from.Unix(), to.Unix())
+
+	sensorData := sensors.GetSensors()
+	calibrationIds := map[time.Time]int64{}
+	updated := make([]*storage.Reading, 0, len(readings))
+	for _, reading := range readings {
+		code := reading.Code
+		if code == 0 {
+			var ok bool
+			if code, ok = sensors.GetSensorCode(reading.Sensor); !ok {
+				result.Skipped++
+				continue
+			}
+		}
+		mapper, ok := sensorData[code]
+		if !ok {
+			result.Skipped++
+			continue
+		}
+
+		calibration := calibrationAt(time.Unix(reading.Timestamp, 0))
+		calibrationId, ok := calibrationIds[calibration.EffectiveFrom]
+		if !ok {
+			var err error
+			if calibrationId, err = api.Store.GetCalibrationId(macAddress, device, calibration); err != nil {
+				return nil, err
+			}
+			calibrationIds[calibration.EffectiveFrom] = calibrationId
+			result.Calibrations = append(result.Calibrations, calibrationId)
+		}
+
+		reading.Code = code
+		reading.CalibrationId = calibrationId
+		reading.ConvertedValue = reading.RawValue
+		if mapper.ConversionFunc != nil {
+			reading.ConvertedValue = mapper.ConversionFunc(reading.RawValue, calibration.CalibrationParameters)
+		}
+		updated = append(updated, reading)
+	}
+
+	if err := api.Store.UpdateConvertedValues(updated); err != nil {
+		return nil, err
+	}
+	result.Updated = len(updated)
+	return result, nil
+}
+
+// storeCalibrations stores the configured calibration sets of all devices, so
+// they are listed before the first reading used them.
+func (api *API) storeCalibrations() {
+	for _, macAddress := range api.Config.MacAddresses() {
+		device, _ := api.Config.Device(macAddress)
+		for _, calibration := range device.CalibrationSets() {
+			if _, err := api.Store.GetCalibrationId(macAddress, device, calibration); err != nil {
+				log.Printf("error: storing calibration of %s failed: %v", macAddress, err)
+			}
+		}
+	}
+}
+
+func (api *API) getCalibrations(c *gin.Context) {
+	_, device, deviceId, ok := api.lookupDevice(c)
+	if !ok {
+		return
+	}
+	calibrations := api.Store.GetCalibrations(deviceId)
+
+	configured := map[string]bool{}
+	for _, set := range device.CalibrationSets() {
+		if _, checksum, err := storage.CalibrationChecksum(set); err == nil {
+			configured[checksum] = true
+		}
+	}
+
+	data := make([]model.Calibration, 0)
+	for _, calibration := range calibrations {
+		modelCalibration := model.Calibration{
+			Id:                    calibration.Id,
+			CalibrationParameters: calibration.CalibrationParameters,
+			Created:               time.Unix(calibration.Timestamp, 0),
+		}
+		set := config.CalibrationSet{CalibrationParameters: calibration.CalibrationParameters}
+		if calibration.EffectiveFrom != 0 {
+			effectiveFrom := time.Unix(calibration.EffectiveFrom, 0)
+			modelCalibration.EffectiveFrom = &effectiveFrom
+			set.EffectiveFrom = effectiveFrom
+		}
+		_, checksum, _ := storage.CalibrationChecksum(set)
+		modelCalibration.OneOff = !configured[checksum]
+		data = append(data, modelCalibration)
+	}
+
+	c.JSON(http.StatusOK, data)
+}
+
+func (api *API) postRecalibration(c *gin.Context) {
+	macAddress := c.Param("macAddress")
+
+	recalibration := model.Recalibration{}
+	if err := c.ShouldBindJSON(&recalibration); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	from, to := time.Unix(0, 0), time.Now()
+	if recalibration.From != nil {
+		from = *recalibration.From
+	}
+	if recalibration.To != nil {
+		to = *recalibration.To
+	}
+
+	result, err := api.Recalibrate(macAddress, from, to, recalibration.CalibrationParameters)
+	if err == ErrUnknownDevice {
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, result)
+}
@@ -0,0 +1,26 @@
+package api
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"koubachi-goserver/pkg/model"
+)
+
+// getRelayQueue lists the payloads waiting per device and upstream server.
+func (api *API) getRelayQueue(c *gin.Context) {
+	data := make([]model.RelayQueue, 0)
+	for _, queue := range api.Relay.Queue() {
+		data = append(data, model.RelayQueue{
+			MacAddress: queue.MacAddress,
+			URL:        queue.URL,
+			Payloads:   queue.Payloads,
+			Oldest:     time.Unix(queue.Oldest, 0),
+			Attempts:   queue.Attempts,
+			LastError:  queue.LastError,
+		})
+	}
+
+	c.JSON(http.StatusOK, data)
+}
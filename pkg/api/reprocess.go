@@ -0,0 +1,44 @@
+package api
+
+import (
+	"log"
+)
+
+// Reprocess replays the archived readings of all devices or, if macAddress is
+// not empty, of a single one through the current conversion functions. Alerts
+// and button actions are not run again. It returns the number of payloads
+// stored.
+func (api *API) Reprocess(macAddress string) (int, error) {
+	payloads := api.Store.GetPayloads(macAddress, EndpointReadings)
+
+	processed := 0
+	for _, payload := range payloads {
+		device, found := api.Config.Device(payload.MacAddress)
+		if !found {
+			log.Printf("skipping payload %d of unknown device %s", payload.Id, payload.MacAddress)
+			continue
+		}
+
+		// payloads that failed to decrypt are retried with the current key
+		body := payload.Plaintext
+		if body == nil {
+			var err error
+			if _, body, _, err = decrypt(device, payload.Ciphertext); err != nil {
+				log.Printf("skipping payload %d of %s: %v", payload.Id, payload.MacAddress, err)
+				continue
+			}
+		}
+
+		data, err := parseReadings(body)
+		if err != nil {
+			log.Printf("skipping payload %d of %s: %v", payload.Id, payload.MacAddress, err)
+			continue
+		}
+
+		if err := api.ingestReadings(payload.MacAddress, device, data, true); err != nil {
+			return processed, err
+		}
+		processed++
+	}
+	return processed, nil
+}
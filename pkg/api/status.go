@@ -0,0 +1,153 @@
+package api
+
+import (
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"koubachi-goserver/pkg/config"
+	"koubachi-goserver/pkg/model"
+	"koubachi-goserver/pkg/sensors"
+)
+
+// battery voltages of two AA cells taken as full and empty, the level in
+// between is interpolated linearly
+const batteryFull = 3.0
+const batteryEmpty = 2.2
+
+// battery levels in percent reported as problems
+const batteryLow = 20.0
+const batteryCritical = 5.0
+
+// a device missing this many transmit intervals is offline
+const offlineIntervals = 3
+
+func (api *API) getStatus(c *gin.Context) {
+	macAddress := c.Param("macAddress")
+
+	device, found := api.Config.Device(macAddress)
+	if !found {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "unknown device"})
+		return
+	}
+
+	c.JSON(http.StatusOK, api.deviceStatus(macAddress, device, time.Now()))
+}
+
+// getStatuses returns the status of all configured devices not deleted.
+func (api *API) getStatuses(c *gin.Context) {
+	now := time.Now()
+
+	data := make([]model.DeviceStatus, 0)
+	for _, macAddress := range api.Config.MacAddresses() {
+		if stored := api.Store.GetDevice(macAddress); stored != nil && stored.Deleted > 0 {
+			continue
+		}
+		device, _ := api.Config.Device(macAddress)
+		data = append(data, api.deviceStatus(macAddress, device, now))
+	}
+
+	c.JSON(http.StatusOK, data)
+}
+
+// deviceStatus collects the latest value of every sensor type and judges the
+// health of a device.
+func (api *API) deviceStatus(macAddress string, device config.Device, now time.Time) model.DeviceStatus {
+	// configured devices that did not send anything yet are not stored
+	var deviceId int64
+	stored := api.Store.GetDevice(macAddress)
+	if stored != nil {
+		deviceId = stored.Id
+	}
+
+	status := model.DeviceStatus{
+		MacAddress: macAddress,
+		Name:       device.Name,
+		Problems:   make([]string, 0),
+		Sensors:    map[string]*model.SensorValue{},
+	}
+	for _, sensorType := range model.SensorTypes {
+		status.Sensors[sensorType] = nil
+	}
+	for _, reading := range api.Store.GetLatestReadings(deviceId) {
+		status.Sensors[reading.Sensor] = &model.SensorValue{
+			Value:     reading.ConvertedValue,
+			Timestamp: time.Unix(reading.Timestamp, 0),
+		}
+	}
+	if event := api.Store.GetLatestEvent(deviceId, model.EventButton); event != nil {
+		status.Sensors[model.Button] = &model.SensorValue{
+			Value:     event.Duration,
+			Timestamp: time.Unix(event.Timestamp, 0),
+		}
+	}
+
+	// the stored name is the one to show, it may have been changed
+	if stored != nil {
+		status.Name = stored.Name
+		if stored.LastSeen > 0 {
+			lastSeen := time.Unix(stored.LastSeen, 0)
+			status.LastSeen = &lastSeen
+		}
+	}
+	if battery := status.Sensors[model.BatteryVoltage]; battery != nil {
+		level := batteryLevel(battery.Value)
+		status.BatteryLevel = &level
+	}
+	settings := sensors.GetSettings(device)
+	status.Plant = api.plant(device)
+	for sensorType, value := range status.Sensors {
+		if value != nil {
+			value.Verdict = judge(status.Plant, settings, sensorType, value.Value)
+		}
+	}
+
+	status.Health, status.Problems = health(status, settings, now)
+	return status
+}
+
+// health returns the verdict on a device status and the problems found.
+func health(status model.DeviceStatus, settings sensors.Settings, now time.Time) (string, []string) {
+	if status.LastSeen == nil {
+		return model.HealthUnknown, []string{model.ProblemNeverSeen}
+	}
+
+	verdict, problems := model.HealthOk, make([]string, 0)
+	warn := func(problem string) {
+		problems = append(problems, problem)
+		if verdict == model.HealthOk {
+			verdict = model.HealthWarning
+		}
+	}
+	fail := func(problem string) {
+		problems = append(problems, problem)
+		verdict = model.HealthCritical
+	}
+
+	offline := time.Duration(offlineIntervals*settings.TransmitInterval) * time.Second
+	if now.Sub(*status.LastSeen) > offline {
+		fail(model.ProblemOffline)
+	}
+	if status.BatteryLevel != nil {
+		switch {
+		case *status.BatteryLevel <= batteryCritical:
+			fail(model.ProblemBatteryEmpty)
+		case *status.BatteryLevel <= batteryLow:
+			warn(model.ProblemBatteryLow)
+		}
+	}
+	// conditions outside of the plant profile, the verdict is the problem
+	for _, sensorType := range []string{model.SoilMoisture, model.Light, model.Temperature} {
+		if value := status.Sensors[sensorType]; value != nil && value.Verdict != "" && value.Verdict != model.VerdictOk {
+			warn(value.Verdict)
+		}
+	}
+	return verdict, problems
+}
+
+// batteryLevel returns the remaining battery in percent.
+func batteryLevel(voltage float64) float64 {
+	level := (voltage - batteryEmpty) / (batteryFull - batteryEmpty) * 100
+	return math.Round(math.Max(0, math.Min(100, level)))
+}
@@ -0,0 +1,34 @@
+package api
+
+import (
+	"log"
+
+	"koubachi-goserver/pkg/config"
+	"koubachi-goserver/pkg/memory"
+	"koubachi-goserver/pkg/postgres"
+	"koubachi-goserver/pkg/sqlite"
+	"koubachi-goserver/pkg/storage"
+)
+
+// openStore opens the storage backend selected in the output configuration.
+func openStore(output config.Output) storage.Store {
+	switch output.Backend {
+	case "", storage.SQLite:
+		db, err := sqlite.New(output.DbFile)
+		if err != nil {
+			log.Fatalf("error: opening sqlite database failed: %v", err)
+		}
+		return db
+	case storage.Postgres:
+		db, err := postgres.New(output.DSN, output.Timescale)
+		if err != nil {
+			log.Fatalf("error: opening postgres database failed: %v", err)
+		}
+		return db
+	case storage.Memory:
+		return memory.New()
+	}
+
+	log.Fatalf("error: unknown storage backend %q", output.Backend)
+	return nil
+}
@@ -1,51 +1,332 @@
 package config
 
 import (
+	"errors"
+	"fmt"
 	"io/ioutil"
 	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
 	"time"
 
 	"gopkg.in/yaml.v2"
 )
 
 type CalibrationParameters struct {
-	TemperatureOffset  float64 `yaml:"LM94022_TEMPERATURE_OFFSET"`
-	SmuDCOffset        float64 `yaml:"RN171_SMU_DC_OFFSET"`
-	SmuGain            float64 `yaml:"RN171_SMU_GAIN"`
-	DCOffsetCorrection float64 `yaml:"SFH3710_DC_OFFSET_CORRECTION"`
-	MoistureContinuity float64 `yaml:"SOIL_MOISTURE_DISCONTINUITY"`
-	MoistureMin        float64 `yaml:"SOIL_MOISTURE_MIN"`
+	TemperatureOffset  float64 `yaml:"LM94022_TEMPERATURE_OFFSET" json:"LM94022_TEMPERATURE_OFFSET"`
+	SmuDCOffset        float64 `yaml:"RN171_SMU_DC_OFFSET" json:"RN171_SMU_DC_OFFSET"`
+	SmuGain            float64 `yaml:"RN171_SMU_GAIN" json:"RN171_SMU_GAIN"`
+	DCOffsetCorrection float64 `yaml:"SFH3710_DC_OFFSET_CORRECTION" json:"SFH3710_DC_OFFSET_CORRECTION"`
+	MoistureContinuity float64 `yaml:"SOIL_MOISTURE_DISCONTINUITY" json:"SOIL_MOISTURE_DISCONTINUITY"`
+	MoistureMin        float64 `yaml:"SOIL_MOISTURE_MIN" json:"SOIL_MOISTURE_MIN"`
+}
+
+// CalibrationSet is a set of calibration parameters valid from EffectiveFrom
+// until the next set of the same device.
+type CalibrationSet struct {
+	EffectiveFrom         time.Time             `yaml:"effective_from" json:"effectiveFrom"`
+	CalibrationParameters CalibrationParameters `yaml:"calibration_parameters" json:"calibrationParameters"`
 }
 
 type Output struct {
-	DbFile string `yaml:"db_file"`
+	// Backend is the storage backend, sqlite if empty, postgres or memory
+	Backend string `yaml:"backend,omitempty"`
+	DbFile  string `yaml:"db_file"`
+	// DSN is the connection string of the postgres backend
+	DSN string `yaml:"dsn,omitempty"`
+	// Timescale stores the readings of the postgres backend in a hypertable
+	Timescale bool `yaml:"timescale,omitempty"`
+	// Archive keeps the raw payloads of all device requests for reprocessing
+	Archive bool `yaml:"archive,omitempty"`
+	// PendingLimit is the number of payloads kept per unknown device, 1000 if 0
+	PendingLimit int `yaml:"pending_limit,omitempty"`
 }
 
 type devices map[string]Device
 
+// SensorSettings overrides the default configuration of a single sensor code.
+// Unset values fall back to the defaults of sensors.GetSensors().
+type SensorSettings struct {
+	Enabled         *bool `yaml:"enabled,omitempty"`
+	PollingInterval *int  `yaml:"polling_interval,omitempty"`
+}
+
+// Action is executed when the button of a device is pressed. Type is one of
+// "webhook", "watered" or "acknowledge", URL is only used by webhooks. An
+// acknowledge action acknowledges the firing alerts of the device.
+type Action struct {
+	Type string `yaml:"type"`
+	URL  string `yaml:"url,omitempty"`
+}
+
+// Relay forwards the readings of a device to another koubachi compatible
+// server. Key and MacAddress default to the ones of the device. A payload
+// failing MaxAttempts times or older than MaxAge (a week if 0) is dropped.
+type Relay struct {
+	URL         string        `yaml:"url"`
+	Key         string        `yaml:"key,omitempty"`
+	MacAddress  string        `yaml:"mac_address,omitempty"`
+	MaxAttempts int           `yaml:"max_attempts,omitempty"`
+	MaxAge      time.Duration `yaml:"max_age,omitempty"`
+}
+
+// Rule raises an alert when a condition like "soil_moisture < 1.5 for 6h"
+// holds for a device. A raised alert only resolves once the value is back past
+// the threshold by the hysteresis, a new alert of the same rule and device is
+// not raised within the cooldown after the last one resolved.
+type Rule struct {
+	Name      string `yaml:"name"`
+	Condition string `yaml:"condition"`
+	// mac addresses of the devices the rule applies to, all devices if empty
+	Devices    []string      `yaml:"devices,omitempty"`
+	Hysteresis float64       `yaml:"hysteresis,omitempty"`
+	Cooldown   time.Duration `yaml:"cooldown,omitempty"`
+	// names of the channels notified, all channels if empty
+	Channels []string `yaml:"channels,omitempty"`
+}
+
+// Channel delivers alert notifications. Type is one of "webhook", "smtp",
+// "ntfy", "gotify" or "log". URL is the webhook, the ntfy topic or the gotify
+// server, Token the ntfy access token or the gotify application token.
+type Channel struct {
+	Type  string `yaml:"type"`
+	URL   string `yaml:"url,omitempty"`
+	Token string `yaml:"token,omitempty"`
+
+	// smtp server as host:port, the login is optional
+	SMTPServer string   `yaml:"smtp_server,omitempty"`
+	Username   string   `yaml:"username,omitempty"`
+	Password   string   `yaml:"password,omitempty"`
+	From       string   `yaml:"from,omitempty"`
+	To         []string `yaml:"to,omitempty"`
+}
+
+type Alerts struct {
+	Rules    []Rule             `yaml:"rules,omitempty"`
+	Channels map[string]Channel `yaml:"channels,omitempty"`
+}
+
+// Range is the optimal range of a sensor value, a bound left out is open.
+type Range struct {
+	Min *float64 `yaml:"min,omitempty" json:"min"`
+	Max *float64 `yaml:"max,omitempty" json:"max"`
+}
+
+// PlantProfile is the optimal soil moisture, light in lux and temperature in
+// degrees Celsius of a plant species.
+type PlantProfile struct {
+	Species     string `yaml:"species" json:"species"`
+	Moisture    Range  `yaml:"moisture" json:"moisture"`
+	Light       Range  `yaml:"light" json:"light"`
+	Temperature Range  `yaml:"temperature" json:"temperature"`
+}
+
 type Device struct {
 	Name                  string                `yaml:"name"`
 	Key                   string                `yaml:"key"`
+	// keys still accepted during a key rotation, responses use the key of the request
+	PreviousKeys          []string              `yaml:"previous_keys,omitempty"`
 	CalibrationParameters CalibrationParameters `yaml:"calibration_parameters"`
+
+	// optional start of the current calibration parameters and earlier sets,
+	// the start is required with earlier sets
+	CalibrationEffectiveFrom time.Time        `yaml:"calibration_effective_from,omitempty"`
+	CalibrationHistory       []CalibrationSet `yaml:"calibration_history,omitempty"`
+
+	// optional transmit settings, unset values use the server defaults
+	TransmitInterval *int                   `yaml:"transmit_interval,omitempty"`
+	TransmitAppLed   *bool                  `yaml:"transmit_app_led,omitempty"`
+	SensorAppLed     *bool                  `yaml:"sensor_app_led,omitempty"`
+	DayThreshold     *float64               `yaml:"day_threshold,omitempty"`
+	Sensors          map[int]SensorSettings `yaml:"sensors,omitempty"`
+
+	ButtonActions []Action `yaml:"button_actions,omitempty"`
+	Relays        []Relay  `yaml:"relays,omitempty"`
+
+	// optional plant profile the readings are judged against, an entry of the
+	// plant catalogue or of the custom plants
+	Plant string `yaml:"plant,omitempty"`
 }
 
 type Config struct {
-	LastConfigChange time.Time
 	Output  Output  `yaml:"output"`
 	Devices devices `yaml:"devices"`
+	// custom plant profiles added to or replacing the bundled catalogue
+	Plants map[string]PlantProfile `yaml:"plants,omitempty"`
+	Alerts Alerts                  `yaml:"alerts,omitempty"`
+
+	file string
+	mu   sync.RWMutex
 }
 
-func New() *Config {
-	config := Config{}
+const File = "config/config.yml"
 
-	yml, err := ioutil.ReadFile("config/config.yml")
+func New() *Config {
+	config, err := Load(File)
 	if err != nil {
 		log.Fatalf("error: %v", err)
 	}
+	return config
+}
+
+// Load reads the configuration from a file, Save writes it back there.
+func Load(file string) (*Config, error) {
+	config := Config{
+		file: file,
+	}
 
-	err = yaml.Unmarshal(yml, &config)
+	yml, err := ioutil.ReadFile(config.file)
 	if err != nil {
-		log.Fatalf("error: %v", err)
+		return nil, err
+	}
+
+	if err := yaml.Unmarshal(yml, &config); err != nil {
+		return nil, err
+	}
+	for macAddress, device := range config.Devices {
+		if err := device.validateCalibrations(); err != nil {
+			return nil, fmt.Errorf("device %s: %v", macAddress, err)
+		}
+	}
+	return &config, nil
+}
+
+// validateCalibrations checks every calibration set of a history has a start,
+// the sets could not be told apart otherwise.
+func (d Device) validateCalibrations() error {
+	if len(d.CalibrationHistory) == 0 {
+		return nil
+	}
+	if d.CalibrationEffectiveFrom.IsZero() {
+		return errors.New("calibration_history needs calibration_effective_from")
+	}
+	for _, set := range d.CalibrationHistory {
+		if set.EffectiveFrom.IsZero() {
+			return errors.New("calibration_history entry without effective_from")
+		}
 	}
-	return &config
-}
\ No newline at end of file
+	return nil
+}
+
+// Keys returns the current key followed by the previous keys of the device.
+func (d Device) Keys() []string {
+	return append([]string{d.Key}, d.PreviousKeys...)
+}
+
+// CalibrationSets returns the calibration history of the device including the
+// current parameters, ordered by EffectiveFrom.
+func (d Device) CalibrationSets() []CalibrationSet {
+	sets := make([]CalibrationSet, 0, len(d.CalibrationHistory)+1)
+	sets = append(sets, d.CalibrationHistory...)
+	sets = append(sets, CalibrationSet{
+		EffectiveFrom:         d.CalibrationEffectiveFrom,
+		CalibrationParameters: d.CalibrationParameters,
+	})
+
+	sort.SliceStable(sets, func(i, j int) bool {
+		return sets[i].EffectiveFrom.Before(sets[j].EffectiveFrom)
+	})
+	return sets
+}
+
+// CalibrationAt returns the calibration set valid at t. Readings older than
+// the first set use the first one.
+func (d Device) CalibrationAt(t time.Time) CalibrationSet {
+	sets := d.CalibrationSets()
+	current := sets[0]
+	for _, set := range sets[1:] {
+		if set.EffectiveFrom.After(t) {
+			break
+		}
+		current = set
+	}
+	return current
+}
+
+// Device returns the configuration of a device and whether it is known.
+func (c *Config) Device(macAddress string) (Device, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	device, ok := c.Devices[macAddress]
+	return device, ok
+}
+
+// MacAddresses returns the mac addresses of all configured devices.
+func (c *Config) MacAddresses() []string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	macAddresses := make([]string, 0, len(c.Devices))
+	for macAddress := range c.Devices {
+		macAddresses = append(macAddresses, macAddress)
+	}
+	sort.Strings(macAddresses)
+	return macAddresses
+}
+
+// SetDevice adds or replaces the configuration of a device.
+func (c *Config) SetDevice(macAddress string, device Device) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.Devices == nil {
+		c.Devices = devices{}
+	}
+	c.Devices[macAddress] = device
+}
+
+// Save writes the configuration back to the file it was loaded from. The file
+// is generated from the parsed configuration, so comments and the order of
+// the keys are lost, the previous file is kept with the suffix .bak. The new
+// file replaces the old one in a single rename and keeps its permissions.
+func (c *Config) Save() error {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if c.file == "" {
+		return errors.New("configuration was not loaded from a file")
+	}
+
+	yml, err := yaml.Marshal(c)
+	if err != nil {
+		return err
+	}
+
+	mode := os.FileMode(0600)
+	if info, err := os.Stat(c.file); err == nil {
+		mode = info.Mode().Perm()
+		previous, err := ioutil.ReadFile(c.file)
+		if err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(c.file+".bak", previous, mode); err != nil {
+			return err
+		}
+	}
+
+	// a crash while writing leaves the temporary file, never a truncated config
+	tmp, err := ioutil.TempFile(filepath.Dir(c.file), filepath.Base(c.file)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(yml); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), mode); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), c.file)
+}
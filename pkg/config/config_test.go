@@ -0,0 +1,118 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testConfig = `# storage of the readings
+output:
+  db_file: "./readings/koubachi.db"
+devices:
+  001122334455:
+    name: "pot"
+    key: 00112233445566778899aabbccddeeff
+`
+
+func TestSave(t *testing.T) {
+	dir := t.TempDir()
+	file := dir + "/config.yml"
+	if err := ioutil.WriteFile(file, []byte(testConfig), 0644); err != nil {
+		t.Fatalf("writing config resulted in error: %s", err)
+	}
+
+	config, err := Load(file)
+	if err != nil {
+		t.Fatalf("loading config resulted in error: %s", err)
+	}
+	config.SetDevice("aabbccddeeff", Device{Name: "adopted", Key: "ffeeddccbbaa99887766554433221100"})
+	if err := config.Save(); err != nil {
+		t.Fatalf("saving config resulted in error: %s", err)
+	}
+
+	saved, err := Load(file)
+	if err != nil {
+		t.Fatalf("loading saved config resulted in error: %s", err)
+	}
+	if device, found := saved.Device("aabbccddeeff"); !found || device.Name != "adopted" {
+		t.Errorf("received device %+v, expected the adopted device", device)
+	}
+	if device, found := saved.Device("001122334455"); !found || device.Name != "pot" {
+		t.Errorf("received device %+v, expected the configured device", device)
+	}
+	if saved.Output.DbFile != "./readings/koubachi.db" {
+		t.Errorf("received db file %q, expected ./readings/koubachi.db", saved.Output.DbFile)
+	}
+
+	if info, err := os.Stat(file); err != nil || info.Mode().Perm() != 0644 {
+		t.Errorf("received file mode %v and error %v, expected -rw-r--r--", info.Mode(), err)
+	}
+	if backup, err := ioutil.ReadFile(file + ".bak"); err != nil || string(backup) != testConfig {
+		t.Errorf("received backup %q and error %v, expected the original file", backup, err)
+	}
+	// no temporary file is left behind
+	if files, _ := ioutil.ReadDir(dir); len(files) != 2 {
+		t.Errorf("received %d files, expected the config and its backup", len(files))
+	}
+}
+
+func TestCalibrationAt(t *testing.T) {
+	may := time.Date(2020, 5, 1, 0, 0, 0, 0, time.UTC)
+	july := time.Date(2020, 7, 1, 0, 0, 0, 0, time.UTC)
+	device := Device{
+		CalibrationParameters:    CalibrationParameters{MoistureMin: 3},
+		CalibrationEffectiveFrom: july,
+		CalibrationHistory:       []CalibrationSet{{EffectiveFrom: may, CalibrationParameters: CalibrationParameters{MoistureMin: 2}}},
+	}
+	current := Device{CalibrationParameters: CalibrationParameters{MoistureMin: 1}}
+
+	tests := []struct {
+		name     string
+		device   Device
+		time     time.Time
+		expected float64
+	}{
+		{"before the first set", device, may.Add(-time.Hour), 2},
+		{"on the start of the first set", device, may, 2},
+		{"within the first set", device, july.Add(-time.Second), 2},
+		{"on the start of the current set", device, july, 3},
+		{"after the start of the current set", device, july.Add(time.Hour), 3},
+		{"without a history", current, may, 1},
+	}
+	for _, test := range tests {
+		if received := test.device.CalibrationAt(test.time).CalibrationParameters.MoistureMin; received != test.expected {
+			t.Errorf("%s: received set %g, expected %g", test.name, received, test.expected)
+		}
+	}
+}
+
+func TestLoadCalibrations(t *testing.T) {
+	history := `
+    calibration_history:
+      - effective_from: 2020-05-01T00:00:00Z
+        calibration_parameters:
+          SOIL_MOISTURE_MIN: 3400.0
+`
+	tests := []struct {
+		name  string
+		yaml  string
+		valid bool
+	}{
+		{"without a history", "", true},
+		{"with the start of the current set", "\n    calibration_effective_from: 2020-07-01T00:00:00Z" + history, true},
+		{"without the start of the current set", history, false},
+		{"without the start of a history set", "\n    calibration_effective_from: 2020-07-01T00:00:00Z\n    calibration_history:\n      - calibration_parameters:\n          SOIL_MOISTURE_MIN: 3400.0\n", false},
+	}
+	for _, test := range tests {
+		file := t.TempDir() + "/config.yml"
+		if err := ioutil.WriteFile(file, []byte(strings.TrimRight(testConfig, "\n")+test.yaml+"\n"), 0644); err != nil {
+			t.Fatalf("writing config resulted in error: %s", err)
+		}
+		if _, err := Load(file); (err == nil) != test.valid {
+			t.Errorf("%s: received error %v, expected valid %t", test.name, err, test.valid)
+		}
+	}
+}
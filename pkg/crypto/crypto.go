@@ -6,9 +6,16 @@ import (
 	"crypto/cipher"
 	"crypto/rand"
 	"encoding/binary"
+	"errors"
 	"hash/crc32"
 	"io"
-	"log"
+)
+
+var (
+	ErrInvalidKey       = errors.New("crypto: invalid key")
+	ErrShortCiphertext  = errors.New("crypto: ciphertext too short")
+	ErrInvalidBlockSize = errors.New("crypto: ciphertext is not a multiple of the block size")
+	ErrBadChecksum      = errors.New("crypto: invalid checksum")
 )
 
 func padding(src []byte) []byte {
@@ -27,7 +34,7 @@ func createCrc(data []byte) []byte {
 	return crc
 }
 
-func Encrypt(key, plaintext []byte) []byte {
+func Encrypt(key, plaintext []byte) ([]byte, error) {
 	// CBC mode works on blocks so plaintext may need to be padded to the
 	// next whole block.
 	plaintext = padding(plaintext)
@@ -36,12 +43,12 @@ func Encrypt(key, plaintext []byte) []byte {
 	plaintext = append(plaintext, createCrc(plaintext)...)
 
 	if len(plaintext)%aes.BlockSize != 0 {
-		log.Panic("error: plaintext is not a multiple of the block size")
+		return nil, ErrInvalidBlockSize
 	}
 
 	block, err := aes.NewCipher(key)
 	if err != nil {
-		log.Panicf("error: %v", err)
+		return nil, ErrInvalidKey
 	}
 
 	// The IV needs to be unique, but not secure. Therefore it's common to
@@ -49,46 +56,69 @@ func Encrypt(key, plaintext []byte) []byte {
 	data := make([]byte, aes.BlockSize+len(plaintext))
 	iv := data[:aes.BlockSize]
 	if _, err := io.ReadFull(rand.Reader, iv); err != nil {
-		log.Panicf("error: %v", err)
+		return nil, err
 	}
 
 	mode := cipher.NewCBCEncrypter(block, iv)
 	mode.CryptBlocks(data[aes.BlockSize:], plaintext)
 
-	return data
+	return data, nil
 }
 
-func Decrypt(key, data []byte) []byte {
+func Decrypt(key, data []byte) ([]byte, error) {
 	block, err := aes.NewCipher(key)
 	if err != nil {
-		log.Panicf("error: %v", err)
+		return nil, ErrInvalidKey
 	}
 
 	// The IV needs to be unique, but not secure. Therefore it's common to
 	// include it at the beginning of the ciphertext.
-	if len(data) < aes.BlockSize {
-		log.Panic("error: persist too short")
+	// A valid ciphertext holds at least one block for the crc after the IV.
+	if len(data) < 2*aes.BlockSize {
+		return nil, ErrShortCiphertext
 	}
 	iv := data[:aes.BlockSize]
 	data = data[aes.BlockSize:]
 
 	// CBC mode always works in whole blocks.
 	if len(data)%aes.BlockSize != 0 {
-		log.Panic("persist is not a multiple of the block size")
+		return nil, ErrInvalidBlockSize
 	}
 
 	mode := cipher.NewCBCDecrypter(block, iv)
 
-	// CryptBlocks can work in-place if the two arguments are the same.
+	// Decrypt into a copy, CryptBlocks in-place would modify the caller's data.
+	data = append([]byte(nil), data...)
 	mode.CryptBlocks(data, data)
 
 	// check crc
 	plaintext, crc := data[:len(data) - crc32.Size], data[len(data) - crc32.Size:]
 	if !bytes.Equal(crc, createCrc(plaintext)) {
-		log.Panic("invalid checksum")
+		return nil, ErrBadChecksum
 	}
 
 	// trim padding
 	plaintext = unpadding(plaintext)
-	return plaintext
-}
\ No newline at end of file
+	return plaintext, nil
+}
+
+// DecryptWithKeys tries the keys in order and returns the plaintext and the
+// index of the first key that decrypts the data with a valid checksum.
+func DecryptWithKeys(keys [][]byte, data []byte) ([]byte, int, error) {
+	err := ErrInvalidKey
+	for i, key := range keys {
+		plaintext, keyErr := Decrypt(key, data)
+		switch keyErr {
+		case nil:
+			return plaintext, i, nil
+		case ErrInvalidKey:
+			continue
+		case ErrBadChecksum:
+			err = keyErr
+		default:
+			// the data itself is invalid, other keys will not help
+			return nil, -1, keyErr
+		}
+	}
+	return nil, -1, err
+}
@@ -3,6 +3,7 @@ package crypto
 import (
 	"bytes"
 	"encoding/hex"
+	"errors"
 	"testing"
 )
 
@@ -22,7 +23,10 @@ func TestDecrypt(t *testing.T) {
 	}
 
 	expected := []byte("just some random boring test data")
-	result := Decrypt(k,v)
+	result, err := Decrypt(k,v)
+	if err != nil {
+		t.Errorf("decrypt resulted in error: %s", err)
+	}
 	if bytes.Compare(result, expected) != 0 {
 		t.Errorf("received \"%s\" , expected \"%s\"", result, expected)
 	}
@@ -32,10 +36,69 @@ func TestEncrypt(t *testing.T) {
 	key := []byte("0123456789abcdef0123456789abcdef")
 	data := []byte("another chunk of boring test data for encryption, long enough to fill multiple blocks")
 
-	encrypted := Encrypt(key, data)
-	decrypted := Decrypt(key, encrypted)
+	encrypted, err := Encrypt(key, data)
+	if err != nil {
+		t.Errorf("encrypt resulted in error: %s", err)
+	}
+	decrypted, err := Decrypt(key, encrypted)
+	if err != nil {
+		t.Errorf("decrypt resulted in error: %s", err)
+	}
 
 	if bytes.Compare(decrypted, data) != 0 {
 		t.Errorf("received \"%s\" , expected \"%s\"", decrypted, data)
 	}
-}
\ No newline at end of file
+}
+
+func TestDecryptErrors(t *testing.T) {
+	key := []byte("0123456789abcdef0123456789abcdef")
+	otherKey := []byte("fedcba9876543210fedcba9876543210")
+
+	encrypted, err := Encrypt(key, []byte("boring test data"))
+	if err != nil {
+		t.Fatalf("encrypt resulted in error: %s", err)
+	}
+
+	tests := []struct {
+		name     string
+		key      []byte
+		data     []byte
+		expected error
+	}{
+		{"invalid key", []byte("short"), encrypted, ErrInvalidKey},
+		{"short ciphertext", key, encrypted[:20], ErrShortCiphertext},
+		{"block size", key, encrypted[:len(encrypted)-1], ErrInvalidBlockSize},
+		{"wrong key", otherKey, encrypted, ErrBadChecksum},
+	}
+	for _, test := range tests {
+		if _, err := Decrypt(test.key, test.data); !errors.Is(err, test.expected) {
+			t.Errorf("%s: received error \"%v\", expected \"%v\"", test.name, err, test.expected)
+		}
+	}
+}
+
+func TestDecryptWithKeys(t *testing.T) {
+	key := []byte("0123456789abcdef0123456789abcdef")
+	previousKey := []byte("fedcba9876543210fedcba9876543210")
+	data := []byte("boring test data")
+
+	encrypted, err := Encrypt(previousKey, data)
+	if err != nil {
+		t.Fatalf("encrypt resulted in error: %s", err)
+	}
+
+	decrypted, index, err := DecryptWithKeys([][]byte{key, nil, previousKey}, encrypted)
+	if err != nil {
+		t.Errorf("decrypt resulted in error: %s", err)
+	}
+	if index != 2 {
+		t.Errorf("received key index %d, expected 2", index)
+	}
+	if bytes.Compare(decrypted, data) != 0 {
+		t.Errorf("received \"%s\" , expected \"%s\"", decrypted, data)
+	}
+
+	if _, _, err := DecryptWithKeys([][]byte{nil, key}, encrypted); err != ErrBadChecksum {
+		t.Errorf("received error \"%v\", expected \"%v\"", err, ErrBadChecksum)
+	}
+}
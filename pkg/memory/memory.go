@@ -0,0 +1,967 @@
+package memory
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"koubachi-goserver/pkg/config"
+	"koubachi-goserver/pkg/model"
+	"koubachi-goserver/pkg/sensors"
+	"koubachi-goserver/pkg/storage"
+)
+
+// Store keeps all data in memory and is lost on restart, it is meant for
+// tests and trying out the server.
+type Store struct {
+	mu sync.Mutex
+
+	lastId          int64
+	devices         []*storage.Device
+	sensors         []*storage.Sensor
+	deviceConfigs   map[int64]deviceConfig
+	deviceInfo      []*storage.DeviceInfo
+	readings        []*storage.Reading
+	calibrations    []*calibration
+	diagnostics     []*storage.Diagnostic
+	events          []*storage.Event
+	alerts          []*storage.Alert
+	payloads        []*storage.Payload
+	pendingPayloads []*storage.PendingPayload
+	relayQueue      []*storage.RelayEntry
+}
+
+type deviceConfig struct {
+	checksum   string
+	lastChange int64
+}
+
+type calibration struct {
+	storage.Calibration
+	checksum string
+}
+
+func New() *Store {
+	return &Store{
+		deviceConfigs: map[int64]deviceConfig{},
+	}
+}
+
+func (s *Store) Close() error {
+	return nil
+}
+
+func (s *Store) nextId() int64 {
+	s.lastId++
+	return s.lastId
+}
+
+func (s *Store) GetDeviceId(macAddress string, device config.Device) int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.getDeviceId(macAddress, device)
+}
+
+func (s *Store) getDeviceId(macAddress string, device config.Device) int64 {
+	for _, d := range s.devices {
+		if d.MacAddress == macAddress {
+			return d.Id
+		}
+	}
+
+	d := &storage.Device{Id: s.nextId(), MacAddress: macAddress, Name: device.Name}
+	s.devices = append(s.devices, d)
+	return d.Id
+}
+
+func (s *Store) GetDevices() []*storage.Device {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	devices := make([]*storage.Device, 0, len(s.devices))
+	for _, d := range s.devices {
+		device := *d
+		devices = append(devices, &device)
+	}
+	return devices
+}
+
+func (s *Store) GetDevice(macAddress string) *storage.Device {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, d := range s.devices {
+		if d.MacAddress == macAddress {
+			device := *d
+			return &device
+		}
+	}
+	return nil
+}
+
+func (s *Store) UpdateDevice(device *storage.Device) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, d := range s.devices {
+		if d.Id == device.Id {
+			d.Name = device.Name
+			d.Notes = device.Notes
+			d.Location = device.Location
+			d.Deleted = device.Deleted
+		}
+	}
+	return nil
+}
+
+// MergeDevices moves the history of the source device to the target device
+// like the SQL store does, the rows of the target win over those of the same
+// time.
+func (s *Store) MergeDevices(sourceId, targetId int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// calibrations both devices have are replaced by the one of the target
+	checksums := map[string]int64{}
+	for _, c := range s.calibrations {
+		if c.DeviceId == targetId {
+			checksums[c.checksum] = c.Id
+		}
+	}
+	calibrationIds := map[int64]int64{}
+	calibrations := s.calibrations[:0]
+	for _, c := range s.calibrations {
+		if c.DeviceId == sourceId {
+			if id, ok := checksums[c.checksum]; ok {
+				calibrationIds[c.Id] = id
+				continue
+			}
+			c.DeviceId = targetId
+		}
+		calibrations = append(calibrations, c)
+	}
+	s.calibrations = calibrations
+
+	type key struct {
+		id        int64
+		name      string
+		timestamp int64
+	}
+	existing := map[key]bool{}
+	for _, r := range s.readings {
+		if r.DeviceId == targetId {
+			existing[key{int64(r.Code), "", r.Timestamp}] = true
+		}
+	}
+	readings := s.readings[:0]
+	for _, r := range s.readings {
+		if r.DeviceId == sourceId {
+			if existing[key{int64(r.Code), "", r.Timestamp}] {
+				continue
+			}
+			r.DeviceId = targetId
+			if id, ok := calibrationIds[r.CalibrationId]; ok {
+				r.CalibrationId = id
+			}
+		}
+		readings = append(readings, r)
+	}
+	s.readings = readings
+
+	existing = map[key]bool{}
+	for _, d := range s.diagnostics {
+		if d.DeviceId == targetId {
+			existing[key{int64(d.Code), "", d.Timestamp}] = true
+		}
+	}
+	diagnostics := s.diagnostics[:0]
+	for _, d := range s.diagnostics {
+		if d.DeviceId == sourceId {
+			if existing[key{int64(d.Code), "", d.Timestamp}] {
+				continue
+			}
+			d.DeviceId = targetId
+		}
+		diagnostics = append(diagnostics, d)
+	}
+	s.diagnostics = diagnostics
+
+	existing = map[key]bool{}
+	for _, e := range s.events {
+		if e.DeviceId == targetId {
+			existing[key{0, e.Type, e.Timestamp}] = true
+		}
+	}
+	events := s.events[:0]
+	for _, e := range s.events {
+		if e.DeviceId == sourceId {
+			if existing[key{0, e.Type, e.Timestamp}] {
+				continue
+			}
+			e.DeviceId = targetId
+		}
+		events = append(events, e)
+	}
+	s.events = events
+
+	for _, i := range s.deviceInfo {
+		if i.DeviceId == sourceId {
+			i.DeviceId = targetId
+		}
+	}
+	for _, a := range s.alerts {
+		if a.DeviceId == sourceId {
+			a.DeviceId = targetId
+		}
+	}
+	delete(s.deviceConfigs, sourceId)
+
+	var source, target *storage.Device
+	devices := s.devices[:0]
+	for _, d := range s.devices {
+		switch d.Id {
+		case sourceId:
+			source = d
+			continue
+		case targetId:
+			target = d
+		}
+		devices = append(devices, d)
+	}
+	s.devices = devices
+
+	if source != nil && target != nil {
+		if target.Name == "" {
+			target.Name = source.Name
+		}
+		if target.Notes == "" {
+			target.Notes = source.Notes
+		}
+		if target.Location == "" {
+			target.Location = source.Location
+		}
+		if source.LastSeen > target.LastSeen {
+			target.LastSeen = source.LastSeen
+		}
+	}
+	return nil
+}
+
+func (s *Store) SetLastSeen(macAddress string, device config.Device, timestamp int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	deviceId := s.getDeviceId(macAddress, device)
+	for _, d := range s.devices {
+		if d.Id == deviceId {
+			d.LastSeen = timestamp
+		}
+	}
+}
+
+func (s *Store) UpdateConfigChecksum(macAddress string, device config.Device, checksum string) int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	deviceId := s.getDeviceId(macAddress, device)
+	if stored, ok := s.deviceConfigs[deviceId]; ok && stored.checksum == checksum {
+		return stored.lastChange
+	}
+
+	now := time.Now().Unix()
+	s.deviceConfigs[deviceId] = deviceConfig{checksum: checksum, lastChange: now}
+	return now
+}
+
+func (s *Store) WriteDeviceInfo(macAddress string, info *sensors.DeviceInfo, raw string, device config.Device) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	deviceId := s.getDeviceId(macAddress, device)
+	for i := len(s.deviceInfo) - 1; i >= 0; i-- {
+		if s.deviceInfo[i].DeviceId == deviceId {
+			if s.deviceInfo[i].Raw == raw {
+				return
+			}
+			break
+		}
+	}
+
+	s.deviceInfo = append(s.deviceInfo, &storage.DeviceInfo{
+		Id:                  s.nextId(),
+		DeviceId:            deviceId,
+		FirmwareVersion:     info.FirmwareVersion,
+		HardwareProductType: info.HardwareProductType,
+		Raw:                 raw,
+		Timestamp:           time.Now().Unix(),
+	})
+}
+
+// GetDeviceInfo returns the announcements of a device, newest first.
+func (s *Store) GetDeviceInfo(deviceId int64) []*storage.DeviceInfo {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	infos := make([]*storage.DeviceInfo, 0)
+	for i := len(s.deviceInfo) - 1; i >= 0; i-- {
+		if s.deviceInfo[i].DeviceId == deviceId {
+			info := *s.deviceInfo[i]
+			infos = append(infos, &info)
+		}
+	}
+	return infos
+}
+
+func (s *Store) GetSensorId(sensor string) int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.getSensorId(sensor)
+}
+
+func (s *Store) getSensorId(name string) int64 {
+	for _, sensor := range s.sensors {
+		if sensor.Name == name {
+			return sensor.Id
+		}
+	}
+
+	sensor := &storage.Sensor{Id: s.nextId(), Name: name}
+	s.sensors = append(s.sensors, sensor)
+	return sensor.Id
+}
+
+func (s *Store) sensorName(sensorId int64) string {
+	for _, sensor := range s.sensors {
+		if sensor.Id == sensorId {
+			return sensor.Name
+		}
+	}
+	return ""
+}
+
+// WriteData stores a batch of converted readings like the SQL databases, a
+// reading already stored for the same sensor and time is replaced.
+func (s *Store) WriteData(macAddress string, data *sensors.Data, device config.Device) ([]*sensors.Reading, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	deviceId := s.getDeviceId(macAddress, device)
+	sensorData := sensors.GetSensors()
+	newEvents := make([]*sensors.Reading, 0)
+	for _, reading := range data.Readings {
+		kind, name := storage.Classify(sensorData[reading.Code])
+		timestamp := int64(reading.Timestamp)
+
+		switch kind {
+		case storage.KindEvent:
+			if s.writeEvent(deviceId, name, reading.ConvertedValue, timestamp) {
+				newEvents = append(newEvents, reading)
+			}
+
+		case storage.KindDiagnostic:
+			s.writeDiagnostic(&storage.Diagnostic{
+				DeviceId:  deviceId,
+				Code:      reading.Code,
+				Name:      name,
+				Value:     reading.ConvertedValue,
+				Timestamp: timestamp,
+			})
+
+		default:
+			calibrationId, err := s.getCalibrationId(deviceId, device.CalibrationAt(time.Unix(timestamp, 0)))
+			if err != nil {
+				return nil, err
+			}
+			s.writeReading(&storage.Reading{
+				DeviceId:       deviceId,
+				RawValue:       reading.RawValue,
+				ConvertedValue: reading.ConvertedValue,
+				Timestamp:      timestamp,
+				SensorId:       s.getSensorId(name),
+				Code:           reading.Code,
+				CalibrationId:  calibrationId,
+			})
+		}
+	}
+	return newEvents, nil
+}
+
+func (s *Store) writeReading(reading *storage.Reading) {
+	for _, r := range s.readings {
+		if r.DeviceId == reading.DeviceId && r.Code == reading.Code && r.Timestamp == reading.Timestamp {
+			reading.Id = r.Id
+			*r = *reading
+			return
+		}
+	}
+
+	reading.Id = s.nextId()
+	s.readings = append(s.readings, reading)
+}
+
+func (s *Store) writeDiagnostic(diagnostic *storage.Diagnostic) {
+	for _, d := range s.diagnostics {
+		if d.DeviceId == diagnostic.DeviceId && d.Code == diagnostic.Code && d.Timestamp == diagnostic.Timestamp {
+			diagnostic.Id = d.Id
+			*d = *diagnostic
+			return
+		}
+	}
+
+	diagnostic.Id = s.nextId()
+	s.diagnostics = append(s.diagnostics, diagnostic)
+}
+
+func (s *Store) GetReadings(deviceId, sensorId int64, query storage.ReadingQuery) []*storage.Reading {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	readings := make([]*storage.Reading, 0)
+	buckets := map[int64]*storage.Reading{}
+	counts := map[int64]int{}
+	for _, r := range s.readings {
+		if r.DeviceId != deviceId || r.SensorId != sensorId || r.Timestamp < query.From || r.Timestamp > query.To {
+			continue
+		}
+		if query.Step <= 0 {
+			reading := *r
+			readings = append(readings, &reading)
+			continue
+		}
+
+		// sums of the bucket, averaged below
+		timestamp := r.Timestamp / query.Step * query.Step
+		bucket, ok := buckets[timestamp]
+		if !ok {
+			bucket = &storage.Reading{DeviceId: deviceId, SensorId: sensorId, Timestamp: timestamp}
+			buckets[timestamp] = bucket
+			readings = append(readings, bucket)
+		}
+		counts[timestamp]++
+		bucket.RawValue += r.RawValue
+		bucket.ConvertedValue += r.ConvertedValue
+		if r.CalibrationId > bucket.CalibrationId {
+			bucket.CalibrationId = r.CalibrationId
+		}
+	}
+	for timestamp, bucket := range buckets {
+		bucket.RawValue /= float64(counts[timestamp])
+		bucket.ConvertedValue /= float64(counts[timestamp])
+	}
+
+	sort.SliceStable(readings, func(i, j int) bool {
+		if query.Descending {
+			return readings[i].Timestamp > readings[j].Timestamp
+		}
+		return readings[i].Timestamp < readings[j].Timestamp
+	})
+	if query.Limit > 0 && len(readings) > query.Limit {
+		readings = readings[:query.Limit]
+	}
+	return readings
+}
+
+func (s *Store) GetAggregates(deviceId, sensorId int64, query storage.AggregateQuery) ([]*storage.Aggregate, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	buckets := map[int64][]float64{}
+	for _, r := range s.readings {
+		if r.DeviceId != deviceId || r.SensorId != sensorId || r.Timestamp < query.From || r.Timestamp > query.To {
+			continue
+		}
+		bucket := (r.Timestamp-query.Offset)/query.Bucket*query.Bucket + query.Offset
+		buckets[bucket] = append(buckets[bucket], r.ConvertedValue)
+	}
+
+	aggregates := make([]*storage.Aggregate, 0, len(buckets))
+	for bucket, values := range buckets {
+		sort.Float64s(values)
+
+		sum := 0.0
+		for _, value := range values {
+			sum += value
+		}
+		aggregate := &storage.Aggregate{
+			Timestamp: bucket,
+			Count:     len(values),
+			Avg:       sum / float64(len(values)),
+			Min:       values[0],
+			Max:       values[len(values)-1],
+		}
+		// nearest rank like the SQL databases
+		for _, p := range query.Percentiles {
+			rank := int(math.Ceil(p * float64(len(values))))
+			if rank < 1 {
+				rank = 1
+			}
+			aggregate.Percentiles = append(aggregate.Percentiles, values[rank-1])
+		}
+		aggregates = append(aggregates, aggregate)
+	}
+
+	sort.Slice(aggregates, func(i, j int) bool {
+		return aggregates[i].Timestamp < aggregates[j].Timestamp
+	})
+	return aggregates, nil
+}
+
+func (s *Store) GetRawReadings(deviceId, from, to int64) []*storage.Reading {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	readings := make([]*storage.Reading, 0)
+	for _, r := range s.readings {
+		if r.DeviceId == deviceId && r.Timestamp >= from && r.Timestamp <= to {
+			reading := *r
+			reading.Sensor = s.sensorName(r.SensorId)
+			readings = append(readings, &reading)
+		}
+	}
+	sort.SliceStable(readings, func(i, j int) bool {
+		return readings[i].Timestamp < readings[j].Timestamp
+	})
+	return readings
+}
+
+func (s *Store) GetLatestReadings(deviceId int64) []*storage.Reading {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	latest := map[int64]*storage.Reading{}
+	for _, r := range s.readings {
+		if r.DeviceId != deviceId {
+			continue
+		}
+		// of two sensors of the same type the lower code wins
+		if l := latest[r.SensorId]; l == nil || r.Timestamp > l.Timestamp || (r.Timestamp == l.Timestamp && r.Code < l.Code) {
+			latest[r.SensorId] = r
+		}
+	}
+
+	readings := make([]*storage.Reading, 0, len(latest))
+	for _, r := range latest {
+		reading := *r
+		reading.Sensor = s.sensorName(r.SensorId)
+		readings = append(readings, &reading)
+	}
+	sort.Slice(readings, func(i, j int) bool {
+		return readings[i].Sensor < readings[j].Sensor
+	})
+	return readings
+}
+
+func (s *Store) UpdateConvertedValues(readings []*storage.Reading) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, reading := range readings {
+		for _, r := range s.readings {
+			if r.Id == reading.Id {
+				r.ConvertedValue = reading.ConvertedValue
+				r.Code = reading.Code
+				r.CalibrationId = reading.CalibrationId
+			}
+		}
+	}
+	return nil
+}
+
+func (s *Store) GetCalibrationId(macAddress string, device config.Device, calibration config.CalibrationSet) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.getCalibrationId(s.getDeviceId(macAddress, device), calibration)
+}
+
+func (s *Store) getCalibrationId(deviceId int64, set config.CalibrationSet) (int64, error) {
+	_, checksum, err := storage.CalibrationChecksum(set)
+	if err != nil {
+		return 0, err
+	}
+	for _, c := range s.calibrations {
+		if c.DeviceId == deviceId && c.checksum == checksum {
+			return c.Id, nil
+		}
+	}
+
+	c := &calibration{
+		Calibration: storage.Calibration{
+			Id:                    s.nextId(),
+			DeviceId:              deviceId,
+			CalibrationParameters: set.CalibrationParameters,
+			Timestamp:             time.Now().Unix(),
+		},
+		checksum: checksum,
+	}
+	if !set.EffectiveFrom.IsZero() {
+		c.EffectiveFrom = set.EffectiveFrom.Unix()
+	}
+	s.calibrations = append(s.calibrations, c)
+	return c.Id, nil
+}
+
+// GetCalibrations returns the calibration sets of a device ordered by the
+// time they became effective.
+func (s *Store) GetCalibrations(deviceId int64) []*storage.Calibration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	calibrations := make([]*storage.Calibration, 0)
+	for _, c := range s.calibrations {
+		if c.DeviceId == deviceId {
+			calibration := c.Calibration
+			calibrations = append(calibrations, &calibration)
+		}
+	}
+	sort.SliceStable(calibrations, func(i, j int) bool {
+		return calibrations[i].EffectiveFrom < calibrations[j].EffectiveFrom
+	})
+	return calibrations
+}
+
+func (s *Store) GetDiagnostics(deviceId int64, days int) []*storage.Diagnostic {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	timestamp := time.Now().AddDate(0, 0, -days).Unix()
+	diagnostics := make([]*storage.Diagnostic, 0)
+	for _, d := range s.diagnostics {
+		if d.DeviceId == deviceId && d.Timestamp > timestamp {
+			diagnostic := *d
+			diagnostics = append(diagnostics, &diagnostic)
+		}
+	}
+	sort.SliceStable(diagnostics, func(i, j int) bool {
+		if diagnostics[i].Timestamp != diagnostics[j].Timestamp {
+			return diagnostics[i].Timestamp < diagnostics[j].Timestamp
+		}
+		return diagnostics[i].Code < diagnostics[j].Code
+	})
+	return diagnostics
+}
+
+func (s *Store) WriteEvent(macAddress, eventType string, duration float64, timestamp int64, device config.Device) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.writeEvent(s.getDeviceId(macAddress, device), eventType, duration, timestamp)
+}
+
+func (s *Store) writeEvent(deviceId int64, eventType string, duration float64, timestamp int64) bool {
+	for _, e := range s.events {
+		if e.DeviceId == deviceId && e.Type == eventType && e.Timestamp == timestamp {
+			return false
+		}
+	}
+
+	s.events = append(s.events, &storage.Event{
+		Id:        s.nextId(),
+		DeviceId:  deviceId,
+		Type:      eventType,
+		Duration:  duration,
+		Timestamp: timestamp,
+	})
+	return true
+}
+
+func (s *Store) GetEvents(deviceId int64, days int) []*storage.Event {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	timestamp := time.Now().AddDate(0, 0, -days).Unix()
+	events := make([]*storage.Event, 0)
+	for _, e := range s.events {
+		if e.DeviceId == deviceId && e.Timestamp > timestamp {
+			event := *e
+			events = append(events, &event)
+		}
+	}
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].Timestamp < events[j].Timestamp
+	})
+	return events
+}
+
+func (s *Store) GetLatestEvent(deviceId int64, eventType string) *storage.Event {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var latest *storage.Event
+	for _, e := range s.events {
+		if e.DeviceId == deviceId && e.Type == eventType && (latest == nil || e.Timestamp >= latest.Timestamp) {
+			latest = e
+		}
+	}
+	if latest == nil {
+		return nil
+	}
+	event := *latest
+	return &event
+}
+
+func (s *Store) WriteAlert(alert *storage.Alert) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored := *alert
+	stored.MacAddress = ""
+	if alert.Id == 0 {
+		alert.Id = s.nextId()
+		stored.Id = alert.Id
+		s.alerts = append(s.alerts, &stored)
+		return nil
+	}
+	for i, a := range s.alerts {
+		if a.Id == alert.Id {
+			stored.Rule, stored.DeviceId, stored.Sensor, stored.Started = a.Rule, a.DeviceId, a.Sensor, a.Started
+			s.alerts[i] = &stored
+		}
+	}
+	return nil
+}
+
+func (s *Store) DeleteAlert(id int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	alerts := s.alerts[:0]
+	for _, a := range s.alerts {
+		if a.Id != id {
+			alerts = append(alerts, a)
+		}
+	}
+	s.alerts = alerts
+}
+
+func (s *Store) GetAlert(id int64) *storage.Alert {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, a := range s.alerts {
+		if a.Id == id {
+			return s.alertWithMacAddress(a)
+		}
+	}
+	return nil
+}
+
+// GetAlerts returns the alerts of all devices or, if deviceId is not 0, of a
+// single one, newest first.
+func (s *Store) GetAlerts(deviceId int64, active bool) []*storage.Alert {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	alerts := make([]*storage.Alert, 0)
+	for i := len(s.alerts) - 1; i >= 0; i-- {
+		a := s.alerts[i]
+		if (deviceId == 0 || a.DeviceId == deviceId) && (!active || a.State != model.AlertResolved) {
+			alerts = append(alerts, s.alertWithMacAddress(a))
+		}
+	}
+	sort.SliceStable(alerts, func(i, j int) bool {
+		return alerts[i].Started > alerts[j].Started
+	})
+	return alerts
+}
+
+func (s *Store) GetLatestAlert(deviceId int64, rule string) *storage.Alert {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var latest *storage.Alert
+	for _, a := range s.alerts {
+		if a.DeviceId == deviceId && a.Rule == rule && (latest == nil || a.Started >= latest.Started) {
+			latest = a
+		}
+	}
+	if latest == nil {
+		return nil
+	}
+	return s.alertWithMacAddress(latest)
+}
+
+// alertWithMacAddress returns a copy of an alert with the mac address of its
+// device like the join of the SQL store.
+func (s *Store) alertWithMacAddress(a *storage.Alert) *storage.Alert {
+	alert := *a
+	for _, d := range s.devices {
+		if d.Id == alert.DeviceId {
+			alert.MacAddress = d.MacAddress
+		}
+	}
+	return &alert
+}
+
+func (s *Store) WritePayload(macAddress, endpoint string, ciphertext, plaintext []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.payloads = append(s.payloads, &storage.Payload{
+		Id:         s.nextId(),
+		MacAddress: macAddress,
+		Endpoint:   endpoint,
+		Ciphertext: ciphertext,
+		Plaintext:  plaintext,
+		Timestamp:  time.Now().Unix(),
+	})
+}
+
+func (s *Store) GetPayloads(macAddress, endpoint string) []*storage.Payload {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	payloads := make([]*storage.Payload, 0)
+	for _, p := range s.payloads {
+		if (macAddress == "" || p.MacAddress == macAddress) && p.Endpoint == endpoint {
+			payload := *p
+			payloads = append(payloads, &payload)
+		}
+	}
+	return payloads
+}
+
+func (s *Store) WritePendingPayload(macAddress, endpoint string, payload []byte, limit int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.pendingPayloads = append(s.pendingPayloads, &storage.PendingPayload{
+		Id:         s.nextId(),
+		MacAddress: macAddress,
+		Endpoint:   endpoint,
+		Payload:    payload,
+		Timestamp:  time.Now().Unix(),
+	})
+
+	// drop the oldest payloads of the device beyond the limit
+	count := 0
+	for _, p := range s.pendingPayloads {
+		if p.MacAddress == macAddress {
+			count++
+		}
+	}
+	payloads := s.pendingPayloads[:0]
+	for _, p := range s.pendingPayloads {
+		if p.MacAddress == macAddress && count > limit {
+			count--
+			continue
+		}
+		payloads = append(payloads, p)
+	}
+	s.pendingPayloads = payloads
+}
+
+func (s *Store) GetPendingPayloads(macAddress string) []*storage.PendingPayload {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	payloads := make([]*storage.PendingPayload, 0)
+	for _, p := range s.pendingPayloads {
+		if macAddress == "" || p.MacAddress == macAddress {
+			payload := *p
+			payloads = append(payloads, &payload)
+		}
+	}
+	return payloads
+}
+
+func (s *Store) DeletePendingPayloads(macAddress string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	payloads := s.pendingPayloads[:0]
+	for _, p := range s.pendingPayloads {
+		if p.MacAddress != macAddress {
+			payloads = append(payloads, p)
+		}
+	}
+	s.pendingPayloads = payloads
+}
+
+func (s *Store) WriteRelayEntry(macAddress, url string, payload []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now().Unix()
+	s.relayQueue = append(s.relayQueue, &storage.RelayEntry{
+		Id:          s.nextId(),
+		MacAddress:  macAddress,
+		URL:         url,
+		Payload:     payload,
+		NextAttempt: now,
+		Timestamp:   now,
+	})
+}
+
+func (s *Store) GetDueRelayEntries(now int64) []*storage.RelayEntry {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entries := make([]*storage.RelayEntry, 0)
+	for _, e := range s.relayQueue {
+		if e.NextAttempt <= now {
+			entry := *e
+			entries = append(entries, &entry)
+		}
+	}
+	return entries
+}
+
+func (s *Store) RetryRelayEntry(id, nextAttempt int64, lastError string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, e := range s.relayQueue {
+		if e.Id == id {
+			e.Attempts++
+			e.NextAttempt = nextAttempt
+			e.LastError = lastError
+		}
+	}
+}
+
+func (s *Store) DeleteRelayEntry(id int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entries := s.relayQueue[:0]
+	for _, e := range s.relayQueue {
+		if e.Id != id {
+			entries = append(entries, e)
+		}
+	}
+	s.relayQueue = entries
+}
+
+func (s *Store) GetRelayQueue() []*storage.RelayQueue {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	type key struct {
+		macAddress string
+		url        string
+	}
+	index := map[key]*storage.RelayQueue{}
+	queues := make([]*storage.RelayQueue, 0)
+	for _, e := range s.relayQueue {
+		queue, ok := index[key{e.MacAddress, e.URL}]
+		if !ok {
+			queue = &storage.RelayQueue{MacAddress: e.MacAddress, URL: e.URL, Oldest: e.Timestamp, Attempts: -1}
+			index[key{e.MacAddress, e.URL}] = queue
+			queues = append(queues, queue)
+		}
+		queue.Payloads++
+		if e.Timestamp < queue.Oldest {
+			queue.Oldest = e.Timestamp
+		}
+		if e.Attempts > queue.Attempts {
+			queue.Attempts, queue.LastError = e.Attempts, e.LastError
+		}
+	}
+	sort.Slice(queues, func(i, j int) bool {
+		if queues[i].MacAddress != queues[j].MacAddress {
+			return queues[i].MacAddress < queues[j].MacAddress
+		}
+		return queues[i].URL < queues[j].URL
+	})
+	return queues
+}
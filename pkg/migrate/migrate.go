@@ -0,0 +1,165 @@
+package migrate
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"time"
+)
+
+// Migration is a versioned schema change. Versions are applied in order, each
+// in its own transaction, and recorded in the schema_migrations table.
+type Migration struct {
+	Version     int
+	Description string
+	Up          func(tx *sql.Tx) error
+	Down        func(tx *sql.Tx) error
+}
+
+// Status is a known migration and when it was applied, zero if not.
+type Status struct {
+	Version     int
+	Description string
+	Applied     int64
+}
+
+// Schema is the ordered list of migrations of a database. Every backend has
+// its own list in its dialect, a version describes the same change in all.
+type Schema struct {
+	Migrations []Migration
+	// statement creating the schema_migrations table if it does not exist
+	CreateTable string
+}
+
+// LatestVersion is the schema version after all migrations.
+func (s *Schema) LatestVersion() int {
+	return s.Migrations[len(s.Migrations)-1].Version
+}
+
+// Version returns the current schema version of a database, 0 if no
+// migration was applied yet.
+func (s *Schema) Version(db *sql.DB) (int, error) {
+	if _, err := db.Exec(s.CreateTable); err != nil {
+		return 0, err
+	}
+
+	row := db.QueryRow("select coalesce(max(version), 0) from schema_migrations")
+	version := new(int)
+	err := row.Scan(version)
+	return *version, err
+}
+
+// Status lists all migrations and when they were applied.
+func (s *Schema) Status(db *sql.DB) ([]*Status, error) {
+	if _, err := db.Exec(s.CreateTable); err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query("select version, applied from schema_migrations")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	applied := map[int]int64{}
+	for rows.Next() {
+		var version int
+		var timestamp int64
+		if err := rows.Scan(&version, &timestamp); err != nil {
+			return nil, err
+		}
+		applied[version] = timestamp
+	}
+
+	status := make([]*Status, 0, len(s.Migrations))
+	for _, m := range s.Migrations {
+		status = append(status, &Status{
+			Version:     m.Version,
+			Description: m.Description,
+			Applied:     applied[m.Version],
+		})
+	}
+	return status, nil
+}
+
+// Migrate applies or reverts migrations until the database is at the target
+// version. It returns the number of migrations run.
+func (s *Schema) Migrate(db *sql.DB, target int) (int, error) {
+	latest := s.LatestVersion()
+	if target < 0 || target > latest {
+		return 0, fmt.Errorf("unknown schema version %d", target)
+	}
+
+	current, err := s.Version(db)
+	if err != nil {
+		return 0, err
+	}
+	if current > latest {
+		return 0, fmt.Errorf("database schema version %d is newer than this server (%d)", current, latest)
+	}
+
+	count := 0
+	for _, m := range s.Migrations {
+		if m.Version <= current || m.Version > target {
+			continue
+		}
+		log.Printf("applying migration %d: %s", m.Version, m.Description)
+		if err := run(db, m.Up, "insert into schema_migrations (version, description, applied) values ($1, $2, $3)", m.Version, m.Description, time.Now().Unix()); err != nil {
+			return count, fmt.Errorf("migration %d failed: %v", m.Version, err)
+		}
+		count++
+	}
+
+	for i := len(s.Migrations) - 1; i >= 0; i-- {
+		m := s.Migrations[i]
+		if m.Version > current || m.Version <= target {
+			continue
+		}
+		log.Printf("reverting migration %d: %s", m.Version, m.Description)
+		if err := run(db, m.Down, "delete from schema_migrations where version = $1", m.Version); err != nil {
+			return count, fmt.Errorf("reverting migration %d failed: %v", m.Version, err)
+		}
+		count++
+	}
+	return count, nil
+}
+
+// run executes a migration step and records it in the same transaction.
+func run(db *sql.DB, step func(tx *sql.Tx) error, record string, args ...interface{}) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := step(tx); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(record, args...); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// ExecAll executes the statements in order and stops at the first error.
+func ExecAll(tx *sql.Tx, statements ...string) error {
+	for _, statement := range statements {
+		if _, err := tx.Exec(statement); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RemoveDuplicates keeps the first of all rows sharing the same values of the
+// columns or expressions.
+func RemoveDuplicates(tx *sql.Tx, table, columns string) error {
+	result, err := tx.Exec("delete from " + table + " where id not in (select min(id) from " + table + " group by " + columns + ")")
+	if err != nil {
+		return err
+	}
+	if removed, _ := result.RowsAffected(); removed > 0 {
+		log.Printf("removed %d duplicates from %s", removed, table)
+	}
+	return nil
+}
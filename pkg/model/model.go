@@ -1,6 +1,10 @@
 package model
 
-import "time"
+import (
+	"time"
+
+	"koubachi-goserver/pkg/config"
+)
 
 const SoilSensorsTrigger = "soil_sensors_trigger"
 const BoardTemperature   = "board_temperature"
@@ -12,10 +16,163 @@ const Button             = "button"
 const Light              = "light"
 const Rssi               = "rssi"
 
+// SensorTypes lists the types of all sensors, button presses included
+var SensorTypes = []string{SoilSensorsTrigger, BoardTemperature, SoilTemperature, BatteryVoltage, SoilMoisture, Temperature, Button, Light, Rssi}
+
+// statistics and error codes of the device. the codes are undocumented and
+// these names are assumptions, not verified against the firmware. the code
+// is stored with every diagnostic, rely on it rather than on the name
+const StatBootCount            = "boot_count"
+const StatWifiConnectCount     = "wifi_connect_count"
+const StatWifiReconnectCount   = "wifi_reconnect_count"
+const StatWifiConnectFailures  = "wifi_connect_failures"
+const StatTransmitCount        = "transmit_count"
+const StatTransmitFailures     = "transmit_failures"
+const StatSensorReadFailures   = "sensor_read_failures"
+const ErrorSensor              = "error_sensor"
+const ErrorWifi                = "error_wifi"
+const ErrorTransmit            = "error_transmit"
+const ErrorFlash               = "error_flash"
+const Unknown                  = "unknown"
+
+// event types
+const EventButton       = "button"
+const EventWatered      = "watered"
+const EventAcknowledged = "acknowledged"
+
+// health verdicts of a device, problems found are listed by name
+const HealthOk       = "ok"
+const HealthWarning  = "warning"
+const HealthCritical = "critical"
+const HealthUnknown  = "unknown"
+
+const ProblemNeverSeen    = "never_seen"
+const ProblemOffline      = "offline"
+const ProblemBatteryLow   = "battery_low"
+const ProblemBatteryEmpty = "battery_empty"
+
+// verdicts on a sensor value judged against the plant profile of a device,
+// values outside of the profile are also health problems
+const VerdictOk         = "ok"
+const VerdictTooDry     = "too_dry"
+const VerdictTooWet     = "too_wet"
+const VerdictTooDark    = "too_dark"
+const VerdictTooBright  = "too_bright"
+const VerdictTooCold    = "too_cold"
+const VerdictTooHot     = "too_hot"
+
+// states of an alert, pending until the condition held long enough
+const AlertPending      = "pending"
+const AlertFiring       = "firing"
+const AlertAcknowledged = "acknowledged"
+const AlertResolved     = "resolved"
+
+// alert notification channels
+const ChannelWebhook = "webhook"
+const ChannelSMTP    = "smtp"
+const ChannelNtfy    = "ntfy"
+const ChannelGotify  = "gotify"
+const ChannelLog     = "log"
+
+// button actions
+const ActionWebhook     = "webhook"
+const ActionWatered     = "watered"
+const ActionAcknowledge = "acknowledge"
+
 type Device struct {
-	Id         int64  `json:"id"`
+	Id         int64      `json:"id"`
+	MacAddress string     `json:"macAddress"`
+	Name       string     `json:"name"`
+	Notes      string     `json:"notes"`
+	Location   string     `json:"location"`
+	Deleted    *time.Time `json:"deleted,omitempty"`
+}
+
+// DeviceUpdate changes the fields of a device which are not null, a deleted
+// device is restored by setting deleted to false.
+type DeviceUpdate struct {
+	Name     *string `json:"name"`
+	Notes    *string `json:"notes"`
+	Location *string `json:"location"`
+	Deleted  *bool   `json:"deleted"`
+}
+
+// DeviceMerge names the device whose history is moved to another one.
+type DeviceMerge struct {
+	MacAddress string `json:"macAddress" binding:"required"`
+}
+
+// DeviceStatus is the current state of a device, sensors without readings are
+// null.
+type DeviceStatus struct {
+	MacAddress   string                  `json:"macAddress"`
+	Name         string                  `json:"name"`
+	LastSeen     *time.Time              `json:"lastSeen"`
+	BatteryLevel *float64                `json:"batteryLevel"`
+	Health       string                  `json:"health"`
+	Problems     []string                `json:"problems"`
+	Plant        *Plant                  `json:"plant"`
+	Sensors      map[string]*SensorValue `json:"sensors"`
+}
+
+type SensorValue struct {
+	Value     float64   `json:"value"`
+	Timestamp time.Time `json:"timestamp"`
+	Verdict   string    `json:"verdict,omitempty"`
+}
+
+// Plant is a plant profile of the catalogue or a custom one.
+type Plant struct {
+	Id string `json:"id"`
+	config.PlantProfile
+}
+
+type DeviceInfo struct {
+	FirmwareVersion     string            `json:"firmwareVersion"`
+	HardwareProductType string            `json:"hardwareProductType"`
+	Parameters          map[string]string `json:"parameters"`
+	Timestamp           time.Time         `json:"timestamp"`
+}
+
+// RelayQueue is the number of payloads waiting to be forwarded to an upstream.
+type RelayQueue struct {
+	MacAddress string    `json:"macAddress"`
+	URL        string    `json:"url"`
+	Payloads   int       `json:"payloads"`
+	Oldest     time.Time `json:"oldest"`
+	Attempts   int       `json:"attempts"`
+	LastError  string    `json:"lastError"`
+}
+
+type PendingDevice struct {
+	MacAddress string    `json:"macAddress"`
+	Payloads   int       `json:"payloads"`
+	FirstSeen  time.Time `json:"firstSeen"`
+	LastSeen   time.Time `json:"lastSeen"`
+}
+
+type PendingDeviceAdoption struct {
+	Name string `json:"name"`
+	Key  string `json:"key" binding:"required"`
+}
+
+type PendingDeviceImport struct {
 	MacAddress string `json:"macAddress"`
-	Name       string `json:"name"`
+	Imported   int    `json:"imported"`
+	Saved      bool   `json:"saved"`
+}
+
+type Recalibration struct {
+	From                  *time.Time                    `json:"from"`
+	To                    *time.Time                    `json:"to"`
+	CalibrationParameters *config.CalibrationParameters `json:"calibrationParameters"`
+}
+
+type RecalibrationResult struct {
+	MacAddress   string  `json:"macAddress"`
+	Calibrations []int64 `json:"calibrations"`
+	Updated      int     `json:"updated"`
+	Skipped      int     `json:"skipped"`
 }
 
 type Sensor struct {
@@ -32,7 +189,82 @@ type Reading struct {
 	Sensor         Sensor    `json:"sensor"`
 }
 
+type Diagnostic struct {
+	Code      int       `json:"code"`
+	Name      string    `json:"name"`
+	Value     float64   `json:"value"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+type Event struct {
+	MacAddress string    `json:"macAddress"`
+	Type       string    `json:"type"`
+	Duration   float64   `json:"duration"`
+	Timestamp  time.Time `json:"timestamp"`
+}
+
+// Calibration is a stored calibration set. OneOff sets are not configured for
+// the device, they were given to a recalibration.
+type Calibration struct {
+	Id                    int64                        `json:"id"`
+	EffectiveFrom         *time.Time                   `json:"effectiveFrom"`
+	CalibrationParameters config.CalibrationParameters `json:"calibrationParameters"`
+	Created               time.Time                    `json:"created"`
+	OneOff                bool                         `json:"oneOff"`
+}
+
+type Alert struct {
+	Id           int64      `json:"id"`
+	Rule         string     `json:"rule"`
+	MacAddress   string     `json:"macAddress"`
+	Sensor       string     `json:"sensor"`
+	State        string     `json:"state"`
+	Value        float64    `json:"value"`
+	Threshold    float64    `json:"threshold"`
+	Started      time.Time  `json:"started"`
+	Updated      time.Time  `json:"updated"`
+	Triggered    *time.Time `json:"triggered"`
+	Acknowledged *time.Time `json:"acknowledged"`
+	Resolved     *time.Time `json:"resolved"`
+}
+
+// AlertRule is a configured rule with its parsed condition.
+type AlertRule struct {
+	Name       string   `json:"name"`
+	Condition  string   `json:"condition"`
+	Sensor     string   `json:"sensor"`
+	Operator   string   `json:"operator"`
+	Threshold  float64  `json:"threshold"`
+	For        string   `json:"for"`
+	Devices    []string `json:"devices"`
+	Hysteresis float64  `json:"hysteresis"`
+	Cooldown   string   `json:"cooldown"`
+	Channels   []string `json:"channels"`
+}
+
+type SensorType struct {
+	Name        string `json:"name"`
+	DisplayName string `json:"displayName"`
+	Unit        string `json:"unit"`
+	Codes       []int  `json:"codes"`
+	Event       bool   `json:"event"`
+}
+
 type ChartData struct {
-	T time.Time `json:"t"`
-	Y float64   `json:"y"`
+	T           time.Time `json:"t"`
+	Y           float64   `json:"y"`
+	Calibration int64     `json:"calibration,omitempty"`
+	Verdict     string    `json:"verdict,omitempty"`
+}
+
+// AggregateData is a chart point of a time bucket with Y set to the first
+// requested statistic, the statistics not requested are left out.
+type AggregateData struct {
+	T           time.Time          `json:"t"`
+	Y           float64            `json:"y"`
+	Count       int                `json:"count"`
+	Avg         *float64           `json:"avg,omitempty"`
+	Min         *float64           `json:"min,omitempty"`
+	Max         *float64           `json:"max,omitempty"`
+	Percentiles map[string]float64 `json:"percentiles,omitempty"`
 }
\ No newline at end of file
@@ -0,0 +1,81 @@
+package plants
+
+import (
+	"io/ioutil"
+	"sort"
+
+	"gopkg.in/yaml.v2"
+	"koubachi-goserver/pkg/config"
+	"koubachi-goserver/pkg/model"
+)
+
+// File is the bundled plant catalogue, relative to the working directory
+// like the other assets.
+const File = "assets/plants.yml"
+
+// Catalogue maps plant ids to their profiles.
+type Catalogue map[string]config.PlantProfile
+
+// Load reads a plant catalogue from a yaml file.
+func Load(file string) (Catalogue, error) {
+	yml, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	catalogue := Catalogue{}
+	if err := yaml.UnmarshalStrict(yml, &catalogue); err != nil {
+		return nil, err
+	}
+	return catalogue, nil
+}
+
+// Add adds profiles to the catalogue, replacing those of the same id.
+func (c Catalogue) Add(profiles map[string]config.PlantProfile) {
+	for id, profile := range profiles {
+		c[id] = profile
+	}
+}
+
+// Ids returns the ids of all profiles, ordered by id.
+func (c Catalogue) Ids() []string {
+	ids := make([]string, 0, len(c))
+	for id := range c {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// verdicts below and above the range of a sensor type
+var verdicts = map[string][2]string{
+	model.SoilMoisture: {model.VerdictTooDry, model.VerdictTooWet},
+	model.Light:        {model.VerdictTooDark, model.VerdictTooBright},
+	model.Temperature:  {model.VerdictTooCold, model.VerdictTooHot},
+}
+
+// Judge returns whether a value of a sensor type is within the range of the
+// profile, too low or too high, named after the sensor type, e.g. too_dry. It
+// is empty if the profile has no range for the sensor type.
+func Judge(profile config.PlantProfile, sensorType string, value float64) string {
+	var r config.Range
+	switch sensorType {
+	case model.SoilMoisture:
+		r = profile.Moisture
+	case model.Light:
+		r = profile.Light
+	case model.Temperature:
+		r = profile.Temperature
+	}
+	if r.Min == nil && r.Max == nil {
+		return ""
+	}
+
+	switch {
+	case r.Min != nil && value < *r.Min:
+		return verdicts[sensorType][0]
+	case r.Max != nil && value > *r.Max:
+		return verdicts[sensorType][1]
+	}
+	return model.VerdictOk
+}
@@ -0,0 +1,58 @@
+package plants
+
+import (
+	"testing"
+
+	"koubachi-goserver/pkg/config"
+	"koubachi-goserver/pkg/model"
+)
+
+func TestCatalogue(t *testing.T) {
+	catalogue, err := Load("../../" + File)
+	if err != nil {
+		t.Fatalf("loading the catalogue resulted in error: %s", err)
+	}
+	if len(catalogue) == 0 {
+		t.Fatalf("received an empty catalogue")
+	}
+
+	for _, id := range catalogue.Ids() {
+		profile := catalogue[id]
+		if profile.Species == "" {
+			t.Errorf("%s: received no species", id)
+		}
+		for name, r := range map[string]config.Range{"moisture": profile.Moisture, "light": profile.Light, "temperature": profile.Temperature} {
+			if r.Min == nil || r.Max == nil || *r.Min > *r.Max {
+				t.Errorf("%s: received %s range %v to %v, expected both bounds in order", id, name, r.Min, r.Max)
+			}
+		}
+	}
+}
+
+func TestJudge(t *testing.T) {
+	min, max := 2.0, 3.0
+	profile := config.PlantProfile{
+		Moisture: config.Range{Min: &min, Max: &max},
+		Light:    config.Range{Min: &min},
+	}
+
+	tests := []struct {
+		sensorType string
+		value      float64
+		expected   string
+	}{
+		{model.SoilMoisture, 1.9, model.VerdictTooDry},
+		{model.SoilMoisture, 2.0, model.VerdictOk},
+		{model.SoilMoisture, 3.0, model.VerdictOk},
+		{model.SoilMoisture, 3.1, model.VerdictTooWet},
+		{model.Light, 1, model.VerdictTooDark},
+		{model.Light, 100000, model.VerdictOk},
+		{model.Temperature, 50, ""},
+		{model.Rssi, -60, ""},
+	}
+	for _, test := range tests {
+		if verdict := Judge(profile, test.sensorType, test.value); verdict != test.expected {
+			t.Errorf("%s %g: received %q, expected %q", test.sensorType, test.value, verdict, test.expected)
+		}
+	}
+}
@@ -0,0 +1,154 @@
+package postgres
+
+import (
+	"database/sql"
+
+	"koubachi-goserver/pkg/migrate"
+)
+
+// MigrationStatus is a known migration and when it was applied, zero if not.
+type MigrationStatus = migrate.Status
+
+// schema of the postgres database, every version makes the same change as the
+// version of the sqlite schema. Databases created before the migrations
+// existed already have all tables of the latest version, so the statements have to
+// tolerate existing tables, columns and indexes.
+var schema = migrate.Schema{
+	CreateTable: "create table if not exists schema_migrations ( version integer constraint schema_migrations_pk primary key, description text not null, applied bigint not null )",
+	Migrations: []migrate.Migration{
+		{
+			Version:     1,
+			Description: "initial schema",
+			Up: func(tx *sql.Tx) error {
+				return migrate.ExecAll(tx,
+					"create table if not exists devices ( id bigserial constraint devices_pk primary key, macaddress text, name text )",
+					"create table if not exists sensors ( id bigserial constraint sensors_pk primary key, name text not null )",
+					"create table if not exists device_configs ( device bigint constraint device_configs_pk primary key references devices, checksum text not null, lastchange bigint not null )",
+					"create table if not exists device_info ( id bigserial constraint device_info_pk primary key, device bigint not null references devices, firmwareversion text, hardwareproducttype text, raw text not null, timestamp bigint not null )",
+					"create table if not exists calibrations ( id bigserial constraint calibrations_pk primary key, device bigint not null references devices, parameters text not null, checksum text not null, effectivefrom bigint, timestamp bigint not null )",
+					"create unique index if not exists calibrations_device_checksum_uindex on calibrations (device, checksum)",
+					// the time column is part of the primary key so readings can become a hypertable
+					"create table if not exists readings ( id bigserial, device bigint not null references devices, rawvalue double precision, convertedvalue double precision, timestamp bigint not null, sensor bigint not null references sensors, code integer, calibration bigint references calibrations, constraint readings_pk primary key (id, timestamp) )",
+					"create table if not exists diagnostics ( id bigserial constraint diagnostics_pk primary key, device bigint not null references devices, code integer not null, name text not null, value double precision, timestamp bigint not null )",
+					"create table if not exists events ( id bigserial constraint events_pk primary key, device bigint not null references devices, type text not null, duration double precision, timestamp bigint not null )",
+					"create table if not exists pending_payloads ( id bigserial constraint pending_payloads_pk primary key, macaddress text not null, endpoint text not null, payload bytea not null, timestamp bigint not null )",
+					"create table if not exists payloads ( id bigserial constraint payloads_pk primary key, macaddress text not null, endpoint text not null, ciphertext bytea not null, plaintext bytea, timestamp bigint not null )",
+					"create table if not exists relay_queue ( id bigserial constraint relay_queue_pk primary key, macaddress text not null, url text not null, payload bytea not null, attempts integer not null default 0, nextattempt bigint not null, lasterror text, timestamp bigint not null )",
+				)
+			},
+			Down: func(tx *sql.Tx) error {
+				return migrate.ExecAll(tx,
+					"drop table if exists relay_queue",
+					"drop table if exists payloads",
+					"drop table if exists pending_payloads",
+					"drop table if exists events",
+					"drop table if exists diagnostics",
+					"drop table if exists readings",
+					"drop table if exists calibrations",
+					"drop table if exists device_info",
+					"drop table if exists device_configs",
+					"drop table if exists sensors",
+					"drop table if exists devices",
+				)
+			},
+		},
+		{
+			Version:     2,
+			Description: "unique device mac addresses and sensor names",
+			Up: func(tx *sql.Tx) error {
+				return migrate.ExecAll(tx,
+					"create unique index if not exists devices_macaddress_uindex on devices (macaddress)",
+					"create unique index if not exists sensors_name_uindex on sensors (name)",
+				)
+			},
+			Down: func(tx *sql.Tx) error {
+				return migrate.ExecAll(tx,
+					"drop index if exists devices_macaddress_uindex",
+					"drop index if exists sensors_name_uindex",
+				)
+			},
+		},
+		{
+			Version:     3,
+			Description: "unique readings, diagnostics and events",
+			Up: func(tx *sql.Tx) error {
+				// readings are unique per sensor code, two sensors can measure the same type
+				return migrate.ExecAll(tx,
+					"create unique index if not exists readings_device_code_timestamp_uindex on readings (device, code, timestamp)",
+					"create unique index if not exists diagnostics_device_code_timestamp_uindex on diagnostics (device, code, timestamp)",
+					"create unique index if not exists events_device_type_timestamp_uindex on events (device, type, timestamp)",
+				)
+			},
+			Down: func(tx *sql.Tx) error {
+				return migrate.ExecAll(tx,
+					"drop index if exists readings_device_code_timestamp_uindex",
+					"drop index if exists diagnostics_device_code_timestamp_uindex",
+					"drop index if exists events_device_type_timestamp_uindex",
+				)
+			},
+		},
+		{
+			Version:     4,
+			Description: "last seen time of devices",
+			Up: func(tx *sql.Tx) error {
+				return migrate.ExecAll(tx, "alter table devices add column if not exists lastseen bigint")
+			},
+			Down: func(tx *sql.Tx) error {
+				return migrate.ExecAll(tx, "alter table devices drop column if exists lastseen")
+			},
+		},
+		{
+			Version:     5,
+			Description: "notes, location and deletion time of devices",
+			Up: func(tx *sql.Tx) error {
+				return migrate.ExecAll(tx,
+					"alter table devices add column if not exists notes text",
+					"alter table devices add column if not exists location text",
+					"alter table devices add column if not exists deleted bigint",
+				)
+			},
+			Down: func(tx *sql.Tx) error {
+				return migrate.ExecAll(tx,
+					"alter table devices drop column if exists notes",
+					"alter table devices drop column if exists location",
+					"alter table devices drop column if exists deleted",
+				)
+			},
+		},
+		{
+			Version:     6,
+			Description: "alerts",
+			Up: func(tx *sql.Tx) error {
+				return migrate.ExecAll(tx,
+					"create table if not exists alerts ( id bigserial constraint alerts_pk primary key, rule text not null, device bigint not null references devices, sensor text not null, state text not null, value double precision, threshold double precision, started bigint not null, updated bigint not null, triggered bigint, acknowledged bigint, resolved bigint )",
+					"create index if not exists alerts_device_rule_index on alerts (device, rule)",
+				)
+			},
+			Down: func(tx *sql.Tx) error {
+				return migrate.ExecAll(tx, "drop table if exists alerts")
+			},
+		},
+	},
+}
+
+// LatestVersion is the schema version after all migrations.
+func LatestVersion() int {
+	return schema.LatestVersion()
+}
+
+// Version returns the current schema version of a database, 0 if no
+// migration was applied yet.
+func Version(db *sql.DB) (int, error) {
+	return schema.Version(db)
+}
+
+// Status lists all migrations and when they were applied.
+func Status(db *sql.DB) ([]*MigrationStatus, error) {
+	return schema.Status(db)
+}
+
+// Migrate applies or reverts migrations until the database is at the target
+// version. It returns the number of migrations run.
+func Migrate(db *sql.DB, target int) (int, error) {
+	return schema.Migrate(db, target)
+}
@@ -0,0 +1,134 @@
+package postgres
+
+import (
+	"database/sql"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"koubachi-goserver/pkg/sqlite"
+)
+
+// TestSchemaVersions checks every sqlite migration has a postgres migration
+// making the same change.
+func TestSchemaVersions(t *testing.T) {
+	db, err := sqlite.Open(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	expected, err := sqlite.Status(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(schema.Migrations) != len(expected) {
+		t.Fatalf("received %d migrations, expected %d", len(schema.Migrations), len(expected))
+	}
+	for i, m := range schema.Migrations {
+		if m.Version != expected[i].Version || m.Description != expected[i].Description {
+			t.Errorf("received migration %d %q, expected %d %q", m.Version, m.Description, expected[i].Version, expected[i].Description)
+		}
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	db, err := Open(testDSN(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if _, err := Migrate(db, LatestVersion()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Migrate(db, 0); err != nil {
+		t.Fatal(err)
+	}
+	var tables int
+	if err := db.QueryRow("select count(*) from information_schema.tables where table_schema = current_schema() and table_name <> 'schema_migrations'").Scan(&tables); err != nil {
+		t.Fatal(err)
+	}
+	if tables != 0 {
+		t.Errorf("received %d tables after reverting all migrations, expected none", tables)
+	}
+
+	count, err := Migrate(db, LatestVersion())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != LatestVersion() {
+		t.Errorf("received %d migrations, expected %d", count, LatestVersion())
+	}
+}
+
+// TestMigrateExisting migrates a database created before the migrations
+// existed, which already has the tables of the latest version.
+func TestMigrateExisting(t *testing.T) {
+	dsn := testDSN(t)
+	db, err := Open(dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if _, err := Migrate(db, LatestVersion()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec("drop table schema_migrations"); err != nil {
+		t.Fatal(err)
+	}
+
+	store, err := New(dsn, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	version, err := Version(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != LatestVersion() {
+		t.Errorf("received version %d, expected %d", version, LatestVersion())
+	}
+}
+
+// testDSN connects to a schema of its own in the database of
+// KOUBACHI_TEST_POSTGRES_DSN, which is dropped after the test. Without the
+// variable the test is skipped.
+func testDSN(t *testing.T) string {
+	dsn := os.Getenv("KOUBACHI_TEST_POSTGRES_DSN")
+	if dsn == "" {
+		t.Skip("KOUBACHI_TEST_POSTGRES_DSN is not set")
+	}
+
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	schema := fmt.Sprintf("koubachi_test_%d", time.Now().UnixNano())
+	if _, err := db.Exec("create schema " + schema); err != nil {
+		db.Close()
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		db.Exec("drop schema " + schema + " cascade")
+		db.Close()
+	})
+
+	if strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://") {
+		u, err := url.Parse(dsn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		query := u.Query()
+		query.Set("search_path", schema)
+		u.RawQuery = query.Encode()
+		return u.String()
+	}
+	return dsn + " search_path=" + schema
+}
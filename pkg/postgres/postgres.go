@@ -0,0 +1,54 @@
+package postgres
+
+import (
+	"database/sql"
+	"fmt"
+
+	_ "github.com/lib/pq"
+	"koubachi-goserver/pkg/sqlstore"
+)
+
+// readings are partitioned into chunks of a week, timestamps are unix seconds
+const hypertable = "select create_hypertable('readings', 'timestamp', chunk_time_interval => 604800, if_not_exists => true, migrate_data => true)"
+
+// New connects to a PostgreSQL database and applies the pending migrations.
+// With timescale the readings are stored in a TimescaleDB hypertable, the
+// extension has to be available on the server.
+func New(dsn string, timescale bool) (*sqlstore.Database, error) {
+	db, err := Open(dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	if timescale {
+		if _, err := db.Exec("create extension if not exists timescaledb"); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("creating schema failed: %v", err)
+		}
+	}
+	if _, err := Migrate(db, LatestVersion()); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if timescale {
+		if _, err := db.Exec(hypertable); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("creating schema failed: %v", err)
+		}
+	}
+
+	return sqlstore.New(db, sqlstore.Postgres), nil
+}
+
+// Open connects to a PostgreSQL database without touching its schema.
+func Open(dsn string) (*sql.DB, error) {
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
@@ -0,0 +1,203 @@
+package relay
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"koubachi-goserver/pkg/config"
+	"koubachi-goserver/pkg/crypto"
+	"koubachi-goserver/pkg/storage"
+)
+
+const ContentType = "application/x-koubachi-aes-encrypted"
+
+// retry backoff of failed forwards, doubled on every attempt
+const minBackoff = 30 * time.Second
+const maxBackoff = time.Hour
+
+// interval of the worker when no new payloads are queued
+const pollInterval = time.Minute
+
+// failing payloads older than this are dropped unless the relay sets a max age
+const defaultMaxAge = 7 * 24 * time.Hour
+
+var errRelayRemoved = errors.New("relay no longer configured")
+
+// Relay forwards decrypted readings to upstream koubachi servers. Payloads are
+// queued in the database first, so local ingestion never depends on an
+// upstream and failed forwards are retried after a restart.
+type Relay struct {
+	Config *config.Config
+	Store  storage.Store
+	Client *http.Client
+
+	wake chan struct{}
+}
+
+func New(config *config.Config, store storage.Store) *Relay {
+	return &Relay{
+		Config: config,
+		Store:  store,
+		Client: &http.Client{Timeout: 30 * time.Second},
+		wake:   make(chan struct{}, 1),
+	}
+}
+
+// Enqueue queues the decrypted readings of a device for all its relays.
+func (r *Relay) Enqueue(macAddress string, device config.Device, body []byte) {
+	if len(device.Relays) == 0 {
+		return
+	}
+
+	for _, relay := range device.Relays {
+		r.Store.WriteRelayEntry(macAddress, relay.URL, body)
+	}
+
+	select {
+	case r.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Run forwards queued payloads until stop is closed.
+func (r *Relay) Run(stop <-chan struct{}) {
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+
+	for {
+		r.Flush()
+
+		select {
+		case <-stop:
+			return
+		case <-r.wake:
+		case <-ticker.C:
+		}
+	}
+}
+
+// Flush forwards all due payloads once and returns the number forwarded.
+func (r *Relay) Flush() int {
+	now := time.Now()
+
+	forwarded := 0
+	for _, entry := range r.Store.GetDueRelayEntries(now.Unix()) {
+		err := r.forward(entry)
+		if err == errRelayRemoved {
+			log.Printf("dropping payload %d of %s for %s: %v", entry.Id, entry.MacAddress, entry.URL, err)
+			r.Store.DeleteRelayEntry(entry.Id)
+			continue
+		}
+		if err != nil && r.expired(entry, now) {
+			log.Printf("error: dropping payload %d of %s for %s after %d attempts: %v", entry.Id, entry.MacAddress, entry.URL, entry.Attempts+1, err)
+			r.Store.DeleteRelayEntry(entry.Id)
+			continue
+		}
+		if err != nil {
+			log.Printf("error: forwarding payload %d of %s to %s failed: %v", entry.Id, entry.MacAddress, entry.URL, err)
+			r.Store.RetryRelayEntry(entry.Id, now.Add(backoff(entry.Attempts)).Unix(), err.Error())
+			continue
+		}
+
+		r.Store.DeleteRelayEntry(entry.Id)
+		forwarded++
+	}
+	return forwarded
+}
+
+// Queue returns the number of payloads waiting per device and upstream.
+func (r *Relay) Queue() []*storage.RelayQueue {
+	return r.Store.GetRelayQueue()
+}
+
+// relay returns the device and relay configuration a payload was queued for,
+// nil if the relay is no longer configured.
+func (r *Relay) relay(entry *storage.RelayEntry) (config.Device, *config.Relay) {
+	device, _ := r.Config.Device(entry.MacAddress)
+	for i := range device.Relays {
+		if device.Relays[i].URL == entry.URL {
+			return device, &device.Relays[i]
+		}
+	}
+	return device, nil
+}
+
+// expired reports whether a payload that failed again is given up, after the
+// maximum number of attempts of its relay or once it is older than the max age.
+func (r *Relay) expired(entry *storage.RelayEntry, now time.Time) bool {
+	maxAttempts, maxAge := 0, defaultMaxAge
+	if _, relay := r.relay(entry); relay != nil {
+		maxAttempts = relay.MaxAttempts
+		if relay.MaxAge > 0 {
+			maxAge = relay.MaxAge
+		}
+	}
+	if maxAttempts > 0 && entry.Attempts+1 >= maxAttempts {
+		return true
+	}
+	return now.Sub(time.Unix(entry.Timestamp, 0)) >= maxAge
+}
+
+// forward posts a queued payload like the device would.
+func (r *Relay) forward(entry *storage.RelayEntry) error {
+	device, relay := r.relay(entry)
+	if relay == nil {
+		return errRelayRemoved
+	}
+
+	keyString, macAddress := device.Key, entry.MacAddress
+	if relay.Key != "" {
+		keyString = relay.Key
+	}
+	if relay.MacAddress != "" {
+		macAddress = relay.MacAddress
+	}
+
+	key, err := hex.DecodeString(keyString)
+	if err != nil {
+		return crypto.ErrInvalidKey
+	}
+	encrypted, err := crypto.Encrypt(key, entry.Payload)
+	if err != nil {
+		return err
+	}
+
+	url := strings.TrimRight(relay.URL, "/") + "/v1/smart_devices/" + macAddress + "/readings"
+	response, err := r.Client.Post(url, ContentType, bytes.NewReader(encrypted))
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return fmt.Errorf("upstream returned %s", response.Status)
+	}
+
+	// a valid response proves the upstream knows the key
+	data, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return err
+	}
+	if _, err := crypto.Decrypt(key, data); err != nil {
+		return fmt.Errorf("invalid upstream response: %v", err)
+	}
+	return nil
+}
+
+func backoff(attempts int) time.Duration {
+	d := minBackoff
+	for i := 0; i < attempts && d < maxBackoff; i++ {
+		d *= 2
+	}
+	if d > maxBackoff {
+		d = maxBackoff
+	}
+	return d
+}
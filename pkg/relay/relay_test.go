@@ -0,0 +1,164 @@
+package relay
+
+import (
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"koubachi-goserver/pkg/config"
+	"koubachi-goserver/pkg/crypto"
+	"koubachi-goserver/pkg/sqlite"
+	"koubachi-goserver/pkg/sqlstore"
+)
+
+const testMacAddress = "001122334455"
+const testKey = "00112233445566778899aabbccddeeff"
+const upstreamKey = "ffeeddccbbaa99887766554433221100"
+
+// upstream is a stand-in koubachi server recording the readings it received.
+type upstream struct {
+	sync.Mutex
+	key      []byte
+	fail     bool
+	paths    []string
+	payloads []string
+}
+
+func (u *upstream) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	u.Lock()
+	defer u.Unlock()
+
+	if u.fail {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+
+	data, _ := ioutil.ReadAll(r.Body)
+	body, err := crypto.Decrypt(u.key, data)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	u.paths = append(u.paths, r.URL.Path)
+	u.payloads = append(u.payloads, string(body))
+
+	response, _ := crypto.Encrypt(u.key, []byte("current_time=1&last_config_change=1"))
+	w.WriteHeader(http.StatusCreated)
+	w.Write(response)
+}
+
+func newTestRelay(t *testing.T, relays ...config.Relay) *Relay {
+	db, err := sqlite.New(t.TempDir() + "/koubachi.db")
+	if err != nil {
+		t.Fatalf("opening database resulted in error: %s", err)
+	}
+	t.Cleanup(func() {
+		db.Client.Close()
+	})
+
+	configuration := &config.Config{
+		Devices: map[string]config.Device{
+			testMacAddress: {
+				Name:   "pot",
+				Key:    testKey,
+				Relays: relays,
+			},
+		},
+	}
+	return New(configuration, db)
+}
+
+func TestForward(t *testing.T) {
+	key, _ := hex.DecodeString(upstreamKey)
+	u := &upstream{key: key}
+	server := httptest.NewServer(u)
+	defer server.Close()
+
+	r := newTestRelay(t, config.Relay{URL: server.URL, Key: upstreamKey, MacAddress: "aabbccddeeff"})
+	device, _ := r.Config.Device(testMacAddress)
+
+	payload := `{"timestamp":1,"readings":[[1,2,3.0]]}`
+	r.Enqueue(testMacAddress, device, []byte(payload))
+
+	if forwarded := r.Flush(); forwarded != 1 {
+		t.Fatalf("forwarded %d payloads, expected 1", forwarded)
+	}
+	if len(u.payloads) != 1 || u.payloads[0] != payload {
+		t.Errorf("upstream received %v, expected %s", u.payloads, payload)
+	}
+	if u.paths[0] != "/v1/smart_devices/aabbccddeeff/readings" {
+		t.Errorf("upstream received path %s", u.paths[0])
+	}
+	if entries := r.Store.GetDueRelayEntries(time.Now().Unix()); len(entries) != 0 {
+		t.Errorf("%d payloads left in the queue, expected 0", len(entries))
+	}
+}
+
+func TestRetry(t *testing.T) {
+	key, _ := hex.DecodeString(testKey)
+	u := &upstream{key: key, fail: true}
+	server := httptest.NewServer(u)
+	defer server.Close()
+
+	r := newTestRelay(t, config.Relay{URL: server.URL})
+	device, _ := r.Config.Device(testMacAddress)
+	r.Enqueue(testMacAddress, device, []byte(`{"timestamp":1,"readings":[]}`))
+
+	// a failed forward stays queued until its backoff is over
+	if forwarded := r.Flush(); forwarded != 0 {
+		t.Fatalf("forwarded %d payloads, expected 0", forwarded)
+	}
+	if entries := r.Store.GetDueRelayEntries(time.Now().Unix()); len(entries) != 0 {
+		t.Errorf("%d payloads due right after a failure, expected 0", len(entries))
+	}
+
+	entries := r.Store.GetDueRelayEntries(time.Now().Add(maxBackoff).Unix())
+	if len(entries) != 1 || entries[0].Attempts != 1 || entries[0].LastError == "" {
+		t.Fatalf("failed forward not queued for a retry, received %+v", entries)
+	}
+
+	u.fail = false
+	r.Store.RetryRelayEntry(entries[0].Id, time.Now().Unix(), "")
+	if forwarded := r.Flush(); forwarded != 1 {
+		t.Errorf("forwarded %d payloads after the upstream recovered, expected 1", forwarded)
+	}
+}
+
+func TestExpiry(t *testing.T) {
+	key, _ := hex.DecodeString(testKey)
+	u := &upstream{key: key, fail: true}
+	server := httptest.NewServer(u)
+	defer server.Close()
+
+	r := newTestRelay(t, config.Relay{URL: server.URL, MaxAttempts: 3, MaxAge: time.Hour})
+	device, _ := r.Config.Device(testMacAddress)
+	r.Enqueue(testMacAddress, device, []byte(`{"timestamp":1,"readings":[]}`))
+	r.Enqueue(testMacAddress, device, []byte(`{"timestamp":2,"readings":[]}`))
+	client := r.Store.(*sqlstore.Database).Client
+
+	r.Flush()
+	queue := r.Queue()
+	if len(queue) != 1 || queue[0].Payloads != 2 || queue[0].Attempts != 1 || queue[0].LastError == "" {
+		t.Fatalf("received queue %+v, expected two payloads failed once", queue)
+	}
+
+	// the first payload is older than the max age
+	entries := r.Store.GetDueRelayEntries(time.Now().Add(maxBackoff).Unix())
+	client.Exec("update relay_queue set timestamp = $1 where id = $2", time.Now().Add(-2*time.Hour).Unix(), entries[0].Id)
+	client.Exec("update relay_queue set nextattempt = 0")
+	r.Flush()
+	if queue := r.Queue(); len(queue) != 1 || queue[0].Payloads != 1 || queue[0].Attempts != 2 {
+		t.Fatalf("received queue %+v, expected the second payload failed twice", queue)
+	}
+
+	// the second payload fails a third time
+	client.Exec("update relay_queue set nextattempt = 0")
+	r.Flush()
+	if queue := r.Queue(); len(queue) != 0 {
+		t.Errorf("received queue %+v, expected the expired payloads dropped", queue)
+	}
+}
@@ -0,0 +1,31 @@
+package sensors
+
+import (
+	"net/url"
+	"strings"
+)
+
+// DeviceInfo is the announcement a device sends when it connects, a url
+// encoded list of device facts.
+type DeviceInfo struct {
+	FirmwareVersion     string
+	HardwareProductType string
+	Parameters          map[string]string
+}
+
+func ParseDeviceInfo(body []byte) (*DeviceInfo, error) {
+	values, err := url.ParseQuery(strings.TrimSpace(string(body)))
+	if err != nil {
+		return nil, err
+	}
+
+	info := &DeviceInfo{
+		FirmwareVersion:     values.Get("firmware_version"),
+		HardwareProductType: values.Get("hardware_product_type"),
+		Parameters:          map[string]string{},
+	}
+	for key := range values {
+		info.Parameters[key] = values.Get(key)
+	}
+	return info, nil
+}
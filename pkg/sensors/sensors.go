@@ -14,6 +14,10 @@ type Sensors struct {
 	Enabled         bool
 	PollingInterval int
 	ConversionFunc  func(x float64, config config.CalibrationParameters) float64
+	// statistics and error codes are stored as diagnostics, not as readings
+	Diagnostic      bool
+	// button presses are stored as events with the converted value as duration
+	Event           bool
 }
 
 type Data struct {
@@ -62,6 +66,7 @@ func GetSensors() map[int]Sensors {
 		ConversionFunc:  func(x float64, config config.CalibrationParameters) float64 {
 			return x / 1000
 		},
+		Event:           true,
 	}
 	sensors[7] = Sensors{
 		Type:            model.Temperature,
@@ -118,77 +123,101 @@ func GetSensors() map[int]Sensors {
 
 	// statistics
 	sensors[4096] = Sensors{
-		Type:            "",
+		Type:            model.StatBootCount,
 		Enabled:         false,
 		PollingInterval: 0,
 		ConversionFunc:  nil,
+		Diagnostic:      true,
 	}
 	sensors[4112] = Sensors{
-		Type:            "",
+		Type:            model.StatWifiConnectCount,
 		Enabled:         false,
 		PollingInterval: 0,
 		ConversionFunc:  nil,
+		Diagnostic:      true,
 	}
 	sensors[4113] = Sensors{
-		Type:            "",
+		Type:            model.StatWifiReconnectCount,
 		Enabled:         false,
 		PollingInterval: 0,
 		ConversionFunc:  nil,
+		Diagnostic:      true,
 	}
 	sensors[4114] = Sensors{
-		Type:            "",
+		Type:            model.StatWifiConnectFailures,
 		Enabled:         false,
 		PollingInterval: 0,
 		ConversionFunc:  nil,
+		Diagnostic:      true,
 	}
 	sensors[4115] = Sensors{
-		Type:            "",
+		Type:            model.StatTransmitCount,
 		Enabled:         false,
 		PollingInterval: 0,
 		ConversionFunc:  nil,
+		Diagnostic:      true,
 	}
 	sensors[4116] = Sensors{
-		Type:            "",
+		Type:            model.StatTransmitFailures,
 		Enabled:         false,
 		PollingInterval: 0,
 		ConversionFunc:  nil,
+		Diagnostic:      true,
 	}
 	sensors[4128] = Sensors{
-		Type:            "",
+		Type:            model.StatSensorReadFailures,
 		Enabled:         false,
 		PollingInterval: 0,
 		ConversionFunc:  nil,
+		Diagnostic:      true,
 	}
 
 	// errors
 	sensors[8192] = Sensors{
-		Type:            "",
+		Type:            model.ErrorSensor,
 		Enabled:         false,
 		PollingInterval: 0,
 		ConversionFunc:  nil,
+		Diagnostic:      true,
 	}
 	sensors[8193] = Sensors{
-		Type:            "",
+		Type:            model.ErrorWifi,
 		Enabled:         false,
 		PollingInterval: 0,
 		ConversionFunc:  nil,
+		Diagnostic:      true,
 	}
 	sensors[8194] = Sensors{
-		Type:            "",
+		Type:            model.ErrorTransmit,
 		Enabled:         false,
 		PollingInterval: 0,
 		ConversionFunc:  nil,
+		Diagnostic:      true,
 	}
 	sensors[8195] = Sensors{
-		Type:            "",
+		Type:            model.ErrorFlash,
 		Enabled:         false,
 		PollingInterval: 0,
 		ConversionFunc:  nil,
+		Diagnostic:      true,
 	}
 
 	return sensors
 }
 
+// GetSensorCode returns the code of a sensor type. Types measured by more than
+// one sensor, like temperature and light, have no unique code.
+func GetSensorCode(sensorType string) (int, bool) {
+	found, code := 0, 0
+	for c, sensor := range GetSensors() {
+		if sensor.Type == sensorType {
+			found++
+			code = c
+		}
+	}
+	return code, found == 1
+}
+
 func convertLm94022Temperature(x float64, config config.CalibrationParameters) float64 {
 	x = (x - config.SmuDCOffset) * config.SmuGain * 3.0
 	x = 453.512485591335 - 163.565776259726 * x - 10.5408332222805 * math.Pow(x, 2) - config.TemperatureOffset - 273.15
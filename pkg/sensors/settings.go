@@ -0,0 +1,116 @@
+package sensors
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"koubachi-goserver/pkg/config"
+)
+
+const DefaultTransmitInterval = 14400
+const DefaultTransmitAppLed = true
+const DefaultSensorAppLed = false
+const DefaultDayThreshold = 10.0
+
+// Settings is the effective configuration sent to a device, the device
+// specific values of config.Device merged over the server defaults.
+type Settings struct {
+	TransmitInterval int
+	TransmitAppLed   bool
+	SensorAppLed     bool
+	DayThreshold     float64
+	Sensors          map[int]Sensors
+}
+
+func GetSettings(device config.Device) Settings {
+	settings := Settings{
+		TransmitInterval: DefaultTransmitInterval,
+		TransmitAppLed:   DefaultTransmitAppLed,
+		SensorAppLed:     DefaultSensorAppLed,
+		DayThreshold:     DefaultDayThreshold,
+		Sensors:          GetSensors(),
+	}
+
+	if device.TransmitInterval != nil {
+		settings.TransmitInterval = *device.TransmitInterval
+	}
+	if device.TransmitAppLed != nil {
+		settings.TransmitAppLed = *device.TransmitAppLed
+	}
+	if device.SensorAppLed != nil {
+		settings.SensorAppLed = *device.SensorAppLed
+	}
+	if device.DayThreshold != nil {
+		settings.DayThreshold = *device.DayThreshold
+	}
+
+	for code, override := range device.Sensors {
+		sensor, ok := settings.Sensors[code]
+		if !ok {
+			continue
+		}
+		if override.Enabled != nil {
+			sensor.Enabled = *override.Enabled
+		}
+		if override.PollingInterval != nil {
+			sensor.PollingInterval = *override.PollingInterval
+		}
+		settings.Sensors[code] = sensor
+	}
+
+	return settings
+}
+
+// Parameters returns the configuration as key value pairs in the format
+// expected by the device, ordered by sensor code.
+func (s Settings) Parameters() []string {
+	parameters := []string{
+		fmt.Sprintf("transmit_interval=%d", s.TransmitInterval),
+		fmt.Sprintf("transmit_app_led=%d", bool2int(s.TransmitAppLed)),
+		fmt.Sprintf("sensor_app_led=%d", bool2int(s.SensorAppLed)),
+		fmt.Sprintf("day_threshold=%s", formatFloat(s.DayThreshold)),
+	}
+
+	codes := make([]int, 0, len(s.Sensors))
+	for code := range s.Sensors {
+		codes = append(codes, code)
+	}
+	sort.Ints(codes)
+
+	for _, code := range codes {
+		sensor := s.Sensors[code]
+		parameters = append(parameters, fmt.Sprintf("sensor_enabled[%d]=%d", code, bool2int(sensor.Enabled)))
+		if sensor.PollingInterval > 0 {
+			parameters = append(parameters, fmt.Sprintf("sensor_polling_interval[%d]=%d", code, sensor.PollingInterval))
+		}
+	}
+	return parameters
+}
+
+// Checksum identifies the effective configuration, it changes whenever one
+// of the parameters sent to the device changes.
+func (s Settings) Checksum() string {
+	sum := sha256.Sum256([]byte(strings.Join(s.Parameters(), "&")))
+	return hex.EncodeToString(sum[:])
+}
+
+// formatFloat always keeps one decimal, the device firmware expects "10.0"
+// rather than "10".
+func formatFloat(f float64) string {
+	s := strconv.FormatFloat(f, 'f', -1, 64)
+	if !strings.Contains(s, ".") {
+		s += ".0"
+	}
+	return s
+}
+
+func bool2int(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,93 @@
+package sensors
+
+import (
+	"sort"
+	"strings"
+
+	"koubachi-goserver/pkg/model"
+)
+
+// Type is a sensor type as stored and queried, measured by one or more sensor
+// codes.
+type Type struct {
+	Name        string
+	DisplayName string
+	Unit        string
+	Codes       []int
+	// button presses are stored as events, not as readings
+	Event bool
+}
+
+type label struct {
+	displayName string
+	unit        string
+}
+
+// display names and units of the converted values
+var labels = map[string]label{
+	model.SoilSensorsTrigger: {"Soil Sensors Trigger", ""},
+	model.BoardTemperature:   {"Board Temperature", ""},
+	model.SoilTemperature:    {"Soil Temperature", "°C"},
+	model.BatteryVoltage:     {"Battery Voltage", "V"},
+	model.SoilMoisture:       {"Soil Moisture", ""},
+	model.Temperature:        {"Ambient Temperature", "°C"},
+	model.Button:             {"Button", "s"},
+	model.Light:              {"Light", "lx"},
+	model.Rssi:               {"RSSI", "dBm"},
+}
+
+// GetTypes returns the sensor types of all codes in GetSensors() except the
+// diagnostics, ordered by name.
+func GetTypes() []Type {
+	types := map[string]*Type{}
+	for code, sensor := range GetSensors() {
+		if sensor.Diagnostic {
+			continue
+		}
+		t, ok := types[sensor.Type]
+		if !ok {
+			t = &Type{
+				Name:        sensor.Type,
+				DisplayName: displayName(sensor.Type),
+				Unit:        labels[sensor.Type].unit,
+				Event:       sensor.Event,
+			}
+			types[sensor.Type] = t
+		}
+		t.Codes = append(t.Codes, code)
+	}
+
+	list := make([]Type, 0, len(types))
+	for _, t := range types {
+		sort.Ints(t.Codes)
+		list = append(list, *t)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Name < list[j].Name
+	})
+	return list
+}
+
+// GetType returns a sensor type by name.
+func GetType(name string) (Type, bool) {
+	for _, t := range GetTypes() {
+		if t.Name == name {
+			return t, true
+		}
+	}
+	return Type{}, false
+}
+
+// displayName falls back to the capitalized words of the name.
+func displayName(name string) string {
+	if label, ok := labels[name]; ok {
+		return label.displayName
+	}
+	words := strings.Split(name, "_")
+	for i, word := range words {
+		if word != "" {
+			words[i] = strings.ToUpper(word[:1]) + word[1:]
+		}
+	}
+	return strings.Join(words, " ")
+}
@@ -0,0 +1,237 @@
+package sqlite
+
+import (
+	"database/sql"
+	"log"
+
+	"koubachi-goserver/pkg/migrate"
+)
+
+// MigrationStatus is a known migration and when it was applied, zero if not.
+type MigrationStatus = migrate.Status
+
+// schema of the sqlite database, never change a released migration, add a new
+// version and the same version to the postgres schema.
+// The first versions also bring databases created before the migrations
+// existed up to date, so they have to tolerate existing tables and columns.
+var schema = migrate.Schema{
+	CreateTable: "create table if not exists schema_migrations ( version INTEGER constraint schema_migrations_pk primary key, description TEXT not null, applied INTEGER not null )",
+	Migrations: []migrate.Migration{
+		{
+			Version:     1,
+			Description: "initial schema",
+			Up: func(tx *sql.Tx) error {
+				err := migrate.ExecAll(tx,
+					"create table if not exists devices ( id INTEGER constraint devices_pk primary key autoincrement, macaddress TEXT, name TEXT )",
+					"create table if not exists sensors ( id INTEGER constraint sensors_pk primary key autoincrement, name TEXT not null )",
+					"create table if not exists device_configs ( device INTEGER constraint device_configs_pk primary key references devices, checksum TEXT not null, lastchange INTEGER not null )",
+					"create table if not exists device_info ( id INTEGER constraint device_info_pk primary key autoincrement, device INTEGER not null references devices, firmwareversion TEXT, hardwareproducttype TEXT, raw TEXT not null, timestamp INTEGER not null )",
+					"create table if not exists calibrations ( id INTEGER constraint calibrations_pk primary key autoincrement, device INTEGER not null references devices, parameters TEXT not null, checksum TEXT not null, timestamp INTEGER not null )",
+					"create unique index if not exists calibrations_device_checksum_uindex on calibrations (device, checksum)",
+					"create table if not exists readings ( id INTEGER constraint readings_pk primary key autoincrement, device INTEGER not null references devices, rawvalue REAL, convertedvalue REAL, timestamp INTEGER not null, sensor INTEGER not null references sensors)",
+					"create table if not exists diagnostics ( id INTEGER constraint diagnostics_pk primary key autoincrement, device INTEGER not null references devices, code INTEGER not null, name TEXT not null, value REAL, timestamp INTEGER not null )",
+					"create table if not exists events ( id INTEGER constraint events_pk primary key autoincrement, device INTEGER not null references devices, type TEXT not null, duration REAL, timestamp INTEGER not null )",
+					"create table if not exists pending_payloads ( id INTEGER constraint pending_payloads_pk primary key autoincrement, macaddress TEXT not null, endpoint TEXT not null, payload BLOB not null, timestamp INTEGER not null )",
+					"create table if not exists payloads ( id INTEGER constraint payloads_pk primary key autoincrement, macaddress TEXT not null, endpoint TEXT not null, ciphertext BLOB not null, plaintext BLOB, timestamp INTEGER not null )",
+					"create table if not exists relay_queue ( id INTEGER constraint relay_queue_pk primary key autoincrement, macaddress TEXT not null, url TEXT not null, payload BLOB not null, attempts INTEGER not null default 0, nextattempt INTEGER not null, lasterror TEXT, timestamp INTEGER not null )",
+				)
+				if err != nil {
+					return err
+				}
+
+				// columns added to existing tables before the migrations existed
+				if err := addColumn(tx, "calibrations", "effectivefrom", "INTEGER"); err != nil {
+					return err
+				}
+				// sensor code and calibration of a reading, needed to recalibrate it
+				if err := addColumn(tx, "readings", "code", "INTEGER"); err != nil {
+					return err
+				}
+				return addColumn(tx, "readings", "calibration", "INTEGER references calibrations")
+			},
+			Down: func(tx *sql.Tx) error {
+				return migrate.ExecAll(tx,
+					"drop table if exists relay_queue",
+					"drop table if exists payloads",
+					"drop table if exists pending_payloads",
+					"drop table if exists events",
+					"drop table if exists diagnostics",
+					"drop table if exists readings",
+					"drop table if exists calibrations",
+					"drop table if exists device_info",
+					"drop table if exists device_configs",
+					"drop table if exists sensors",
+					"drop table if exists devices",
+				)
+			},
+		},
+		{
+			// the indexes were meant to be created with the tables, but only the
+			// first statement of a prepared statement is executed
+			Version:     2,
+			Description: "unique device mac addresses and sensor names",
+			Up: func(tx *sql.Tx) error {
+				err := mergeDuplicates(tx, "sensors", "name", "sensor", "readings")
+				if err != nil {
+					return err
+				}
+				err = mergeDuplicates(tx, "devices", "macaddress", "device", "readings", "device_configs", "device_info", "diagnostics", "events", "calibrations")
+				if err != nil {
+					return err
+				}
+				return migrate.ExecAll(tx,
+					"create unique index if not exists devices_macaddress_uindex on devices (macaddress)",
+					"create unique index if not exists sensors_name_uindex on sensors (name)",
+				)
+			},
+			Down: func(tx *sql.Tx) error {
+				return migrate.ExecAll(tx,
+					"drop index if exists devices_macaddress_uindex",
+					"drop index if exists sensors_name_uindex",
+				)
+			},
+		},
+		{
+			Version:     3,
+			Description: "unique readings, diagnostics and events",
+			Up: func(tx *sql.Tx) error {
+				// keep the first of duplicates written before the indexes existed.
+				// readings stored before their code was recorded only count as
+				// duplicates with the same raw value, a retransmitted batch
+				if err := migrate.RemoveDuplicates(tx, "readings", "device, code, timestamp, sensor, case when code is null then rawvalue end"); err != nil {
+					return err
+				}
+				if err := migrate.RemoveDuplicates(tx, "diagnostics", "device, code, timestamp"); err != nil {
+					return err
+				}
+				if err := migrate.RemoveDuplicates(tx, "events", "device, type, timestamp"); err != nil {
+					return err
+				}
+				// readings are unique per sensor code, two sensors can measure the same type
+				return migrate.ExecAll(tx,
+					"create unique index if not exists readings_device_code_timestamp_uindex on readings (device, code, timestamp)",
+					"create unique index if not exists diagnostics_device_code_timestamp_uindex on diagnostics (device, code, timestamp)",
+					"create unique index if not exists events_device_type_timestamp_uindex on events (device, type, timestamp)",
+				)
+			},
+			Down: func(tx *sql.Tx) error {
+				return migrate.ExecAll(tx,
+					"drop index if exists readings_device_code_timestamp_uindex",
+					"drop index if exists diagnostics_device_code_timestamp_uindex",
+					"drop index if exists events_device_type_timestamp_uindex",
+				)
+			},
+		},
+		{
+			Version:     4,
+			Description: "last seen time of devices",
+			Up: func(tx *sql.Tx) error {
+				return migrate.ExecAll(tx, "alter table devices add column lastseen INTEGER")
+			},
+			Down: func(tx *sql.Tx) error {
+				// sqlite before 3.35 cannot drop columns
+				return migrate.ExecAll(tx,
+					"create table devices_old ( id INTEGER constraint devices_pk primary key autoincrement, macaddress TEXT, name TEXT )",
+					"insert into devices_old (id, macaddress, name) select id, macaddress, name from devices",
+					"drop table devices",
+					"alter table devices_old rename to devices",
+					"create unique index if not exists devices_macaddress_uindex on devices (macaddress)",
+				)
+			},
+		},
+		{
+			Version:     5,
+			Description: "notes, location and deletion time of devices",
+			Up: func(tx *sql.Tx) error {
+				return migrate.ExecAll(tx,
+					"alter table devices add column notes TEXT",
+					"alter table devices add column location TEXT",
+					"alter table devices add column deleted INTEGER",
+				)
+			},
+			Down: func(tx *sql.Tx) error {
+				return migrate.ExecAll(tx,
+					"create table devices_old ( id INTEGER constraint devices_pk primary key autoincrement, macaddress TEXT, name TEXT, lastseen INTEGER )",
+					"insert into devices_old (id, macaddress, name, lastseen) select id, macaddress, name, lastseen from devices",
+					"drop table devices",
+					"alter table devices_old rename to devices",
+					"create unique index if not exists devices_macaddress_uindex on devices (macaddress)",
+				)
+			},
+		},
+		{
+			Version:     6,
+			Description: "alerts",
+			Up: func(tx *sql.Tx) error {
+				return migrate.ExecAll(tx,
+					"create table alerts ( id INTEGER constraint alerts_pk primary key autoincrement, rule TEXT not null, device INTEGER not null references devices, sensor TEXT not null, state TEXT not null, value REAL, threshold REAL, started INTEGER not null, updated INTEGER not null, triggered INTEGER, acknowledged INTEGER, resolved INTEGER )",
+					"create index alerts_device_rule_index on alerts (device, rule)",
+				)
+			},
+			Down: func(tx *sql.Tx) error {
+				return migrate.ExecAll(tx, "drop table if exists alerts")
+			},
+		},
+	},
+}
+
+// LatestVersion is the schema version after all migrations.
+func LatestVersion() int {
+	return schema.LatestVersion()
+}
+
+// Version returns the current schema version of a database, 0 if no
+// migration was applied yet.
+func Version(db *sql.DB) (int, error) {
+	return schema.Version(db)
+}
+
+// Status lists all migrations and when they were applied.
+func Status(db *sql.DB) ([]*MigrationStatus, error) {
+	return schema.Status(db)
+}
+
+// Migrate applies or reverts migrations until the database is at the target
+// version. It returns the number of migrations run.
+func Migrate(db *sql.DB, target int) (int, error) {
+	return schema.Migrate(db, target)
+}
+
+// addColumn adds a column to a table created before the column existed.
+func addColumn(tx *sql.Tx, table, column, definition string) error {
+	row := tx.QueryRow("select count(*) from pragma_table_info($1) where name = $2", table, column)
+	count := new(int)
+	if err := row.Scan(count); err != nil || *count > 0 {
+		return err
+	}
+
+	_, err := tx.Exec("alter table " + table + " add column " + column + " " + definition)
+	return err
+}
+
+// mergeDuplicates keeps the first of all rows of a table sharing the same
+// column and moves the rows referencing the others over to it. Referencing
+// rows which would become duplicates themselves are dropped.
+func mergeDuplicates(tx *sql.Tx, table, column, reference string, referencing ...string) error {
+	duplicates := "(select id from " + table + " where id not in (select min(id) from " + table + " group by " + column + "))"
+	first := "(select min(t.id) from " + table + " t where t." + column + " = (select " + column + " from " + table + " where id = " + reference + "))"
+
+	for _, r := range referencing {
+		err := migrate.ExecAll(tx,
+			"update or ignore "+r+" set "+reference+" = "+first+" where "+reference+" in "+duplicates,
+			"delete from "+r+" where "+reference+" in "+duplicates,
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	result, err := tx.Exec("delete from " + table + " where id in " + duplicates)
+	if err != nil {
+		return err
+	}
+	if removed, _ := result.RowsAffected(); removed > 0 {
+		log.Printf("merged %d duplicates of %s", removed, table)
+	}
+	return nil
+}
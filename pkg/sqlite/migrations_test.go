@@ -0,0 +1,111 @@
+package sqlite
+
+import (
+	"testing"
+)
+
+// legacy is a database written before the migrations existed, without the
+// unique indexes on devices and sensors.
+var legacy = []string{
+	"create table readings ( id INTEGER constraint readings_pk primary key autoincrement, device INTEGER not null references devices, rawvalue REAL, convertedvalue REAL, timestamp INTEGER not null, sensor INTEGER not null references sensors)",
+	"create table devices ( id INTEGER constraint devices_pk primary key autoincrement, macaddress TEXT, name TEXT )",
+	"create table sensors ( id INTEGER constraint sensors_pk primary key autoincrement, name TEXT not null )",
+	"insert into devices (macaddress, name) values ('001122334455', 'pot'), ('001122334455', 'pot'), ('aabbccddeeff', 'other')",
+	"insert into sensors (name) values ('temperature'), ('temperature')",
+	"insert into readings (device, rawvalue, convertedvalue, timestamp, sensor) values (1, 1, 1, 100, 1), (2, 2, 2, 200, 2), (2, 3, 3, 100, 1), (1, 1, 1, 100, 1)",
+}
+
+func TestMigrateLegacy(t *testing.T) {
+	file := t.TempDir() + "/koubachi.db"
+	db, err := Open(file)
+	if err != nil {
+		t.Fatalf("open resulted in error: %s", err)
+	}
+	for _, statement := range legacy {
+		if _, err := db.Exec(statement); err != nil {
+			t.Fatalf("%s resulted in error: %s", statement, err)
+		}
+	}
+	db.Close()
+
+	store, err := New(file)
+	if err != nil {
+		t.Fatalf("migration resulted in error: %s", err)
+	}
+	defer store.Close()
+
+	if devices := store.GetDevices(); len(devices) != 2 {
+		t.Errorf("received %d devices, expected 2", len(devices))
+	}
+
+	// readings of the duplicate device and sensor belong to the first ones,
+	// the retransmitted reading is removed, the one of a second sensor of the
+	// same type with a different value is kept
+	rows, err := store.Client.Query("select device, sensor, timestamp, rawvalue from readings order by timestamp, id")
+	if err != nil {
+		t.Fatalf("query resulted in error: %s", err)
+	}
+	defer rows.Close()
+
+	expected := [][4]int64{{1, 1, 100, 1}, {1, 1, 100, 3}, {1, 1, 200, 2}}
+	count := 0
+	for rows.Next() {
+		var reading [4]int64
+		rows.Scan(&reading[0], &reading[1], &reading[2], &reading[3])
+		if count < len(expected) && reading != expected[count] {
+			t.Errorf("received reading %v, expected %v", reading, expected[count])
+		}
+		count++
+	}
+	if count != len(expected) {
+		t.Errorf("received %d readings, expected %d", count, len(expected))
+	}
+
+	if _, err := store.Client.Exec("insert into devices (macaddress, name) values ('001122334455', 'pot')"); err == nil {
+		t.Errorf("duplicate mac address accepted, expected a unique index")
+	}
+}
+
+func TestMigrateDown(t *testing.T) {
+	db, err := Open(t.TempDir() + "/koubachi.db")
+	if err != nil {
+		t.Fatalf("open resulted in error: %s", err)
+	}
+	defer db.Close()
+
+	for _, target := range []int{LatestVersion(), 1, 0, LatestVersion()} {
+		if _, err := Migrate(db, target); err != nil {
+			t.Fatalf("migrating to %d resulted in error: %s", target, err)
+		}
+		if version, _ := Version(db); version != target {
+			t.Errorf("received version %d, expected %d", version, target)
+		}
+	}
+
+	if _, err := Migrate(db, LatestVersion()+1); err == nil {
+		t.Errorf("migrating to an unknown version succeeded")
+	}
+}
+
+func TestMigrateReadingsIndex(t *testing.T) {
+	store, err := New(t.TempDir() + "/koubachi.db")
+	if err != nil {
+		t.Fatalf("migration resulted in error: %s", err)
+	}
+	defer store.Close()
+
+	// temperatures of codes 7 and 15 taken at the same time are both kept
+	statements := []string{
+		"insert into devices (macaddress, name) values ('001122334455', 'pot')",
+		"insert into sensors (name) values ('temperature')",
+		"insert into readings (device, rawvalue, convertedvalue, timestamp, sensor, code) values (1, 1, 21.5, 100, 1, 7), (1, 2, 22.5, 100, 1, 15)",
+	}
+	for _, statement := range statements {
+		if _, err := store.Client.Exec(statement); err != nil {
+			t.Fatalf("%s resulted in error: %s", statement, err)
+		}
+	}
+	if _, err := store.Client.Exec("insert into readings (device, rawvalue, convertedvalue, timestamp, sensor, code) values (1, 1, 21.5, 100, 1, 7)"); err == nil {
+		t.Errorf("duplicate reading accepted, expected a unique index")
+	}
+}
@@ -0,0 +1,53 @@
+package sqlite
+
+import (
+	"testing"
+
+	"koubachi-goserver/pkg/config"
+	"koubachi-goserver/pkg/storage"
+)
+
+// TestFailingQueries checks a store whose database went away logs the failed
+// queries and returns empty results instead of panicking.
+func TestFailingQueries(t *testing.T) {
+	store, err := New(t.TempDir() + "/koubachi.db")
+	if err != nil {
+		t.Fatalf("migration resulted in error: %s", err)
+	}
+	store.Client.Close()
+
+	device := config.Device{Name: "pot"}
+	store.UpdateConfigChecksum("001122334455", device, "checksum")
+	if store.WriteEvent("001122334455", "button", 0, 100, device) {
+		t.Errorf("received a stored event, expected none")
+	}
+	store.SetLastSeen("001122334455", device, 100)
+	store.DeleteAlert(1)
+	store.WritePayload("001122334455", "readings", []byte{1}, nil)
+	store.WriteRelayEntry("001122334455", "http://localhost", []byte{1})
+	store.RetryRelayEntry(1, 100, "failed")
+	store.DeleteRelayEntry(1)
+	store.WritePendingPayload("001122334455", "readings", []byte{1}, 10)
+	store.DeletePendingPayloads("001122334455")
+
+	results := map[string]int{
+		"calibrations":      len(store.GetCalibrations(1)),
+		"raw readings":      len(store.GetRawReadings(1, 0, 100)),
+		"latest readings":   len(store.GetLatestReadings(1)),
+		"diagnostics":       len(store.GetDiagnostics(1, 1)),
+		"events":            len(store.GetEvents(1, 1)),
+		"readings":          len(store.GetReadings(1, 1, storage.ReadingQuery{})),
+		"devices":           len(store.GetDevices()),
+		"device info":       len(store.GetDeviceInfo(1)),
+		"alerts":            len(store.GetAlerts(0, false)),
+		"payloads":          len(store.GetPayloads("", "readings")),
+		"due relay entries": len(store.GetDueRelayEntries(100)),
+		"relay queue":       len(store.GetRelayQueue()),
+		"pending payloads":  len(store.GetPendingPayloads("")),
+	}
+	for name, count := range results {
+		if count != 0 {
+			t.Errorf("received %d %s, expected none", count, name)
+		}
+	}
+}
@@ -0,0 +1,831 @@
+package sqlstore
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"koubachi-goserver/pkg/config"
+	"koubachi-goserver/pkg/model"
+	"koubachi-goserver/pkg/sensors"
+	"koubachi-goserver/pkg/storage"
+	"log"
+	"time"
+)
+
+// Dialect selects the few statements differing between the SQL databases.
+type Dialect int
+
+const (
+	SQLite Dialect = iota
+	Postgres
+)
+
+// Database implements storage.Store on top of database/sql. The schema is
+// created by the packages of the individual databases.
+type Database struct {
+	Client  *sql.DB
+	dialect Dialect
+}
+
+func New(client *sql.DB, dialect Dialect) *Database {
+	return &Database{
+		Client:  client,
+		dialect: dialect,
+	}
+}
+
+func (db *Database) Close() error {
+	return db.Client.Close()
+}
+
+// queryer is implemented by both *sql.DB and *sql.Tx.
+type queryer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Prepare(query string) (*sql.Stmt, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// insert runs an insert statement and returns the id of the new row. SQLite
+// reports it as last insert id, PostgreSQL only returns it when asked for.
+func (db *Database) insert(q queryer, query string, args ...interface{}) (int64, error) {
+	if db.dialect == Postgres {
+		id := new(int64)
+		err := q.QueryRow(query+" returning id", args...).Scan(id)
+		return *id, err
+	}
+
+	statement, err := q.Prepare(query)
+	if err != nil {
+		return 0, err
+	}
+	defer statement.Close()
+
+	result, err := statement.Exec(args...)
+	if err != nil {
+		return 0, err
+	}
+	return result.LastInsertId()
+}
+
+// GetDeviceId returns the id of a device, an unknown device is created. It
+// returns 0 if the database failed, the error is logged.
+func (db *Database) GetDeviceId(macAddress string, device config.Device) int64 {
+	id, err := db.getDeviceId(db.Client, macAddress, device)
+	if err != nil {
+		log.Printf("error: getting id of device %s failed: %v", macAddress, err)
+	}
+	return id
+}
+
+func (db *Database) getDeviceId(q queryer, macAddress string, device config.Device) (int64, error) {
+	return getOrInsertId(q,
+		"select id from devices where macaddress = $1", []interface{}{macAddress},
+		"insert into devices (macaddress, name) values ($1, $2) on conflict (macaddress) do nothing", []interface{}{macAddress, device.Name},
+	)
+}
+
+// getOrInsertId selects the id of a row and inserts the row if there is none.
+// A row inserted concurrently in between is not inserted again but selected.
+func getOrInsertId(q queryer, selectQuery string, selectArgs []interface{}, insertQuery string, insertArgs []interface{}) (int64, error) {
+	id := new(int64)
+	err := q.QueryRow(selectQuery, selectArgs...).Scan(id)
+	if err != sql.ErrNoRows {
+		return *id, err
+	}
+
+	if _, err := q.Exec(insertQuery, insertArgs...); err != nil {
+		return 0, err
+	}
+	if err := q.QueryRow(selectQuery, selectArgs...).Scan(id); err != nil {
+		return 0, err
+	}
+	return *id, nil
+}
+
+// UpdateConfigChecksum records the checksum of the effective configuration of
+// a device and returns the time it last changed. A checksum different from the
+// stored one counts as a change now.
+func (db *Database) UpdateConfigChecksum(macAddress string, device config.Device, checksum string) int64 {
+	deviceId := db.GetDeviceId(macAddress, device)
+
+	row := db.Client.QueryRow("select checksum, lastchange from device_configs where device = $1", deviceId)
+	storedChecksum := new(string)
+	lastChange := new(int64)
+	err := row.Scan(storedChecksum, lastChange)
+	if err == nil && *storedChecksum == checksum {
+		return *lastChange
+	}
+
+	now := time.Now().Unix()
+	if _, err := db.Client.Exec("insert into device_configs (device, checksum, lastchange) values ($1, $2, $3) on conflict (device) do update set checksum = excluded.checksum, lastchange = excluded.lastchange", deviceId, checksum, now); err != nil {
+		log.Printf("error: updating config checksum of device %s failed: %v", macAddress, err)
+	}
+	return now
+}
+
+// GetSensorId returns the id of a sensor type, an unknown type is created. It
+// returns 0 if the database failed, the error is logged.
+func (db *Database) GetSensorId(sensor string) int64 {
+	id, err := db.getSensorId(db.Client, sensor)
+	if err != nil {
+		log.Printf("error: getting id of sensor %s failed: %v", sensor, err)
+	}
+	return id
+}
+
+func (db *Database) getSensorId(q queryer, sensor string) (int64, error) {
+	return getOrInsertId(q,
+		"select id from sensors where name = $1", []interface{}{sensor},
+		"insert into sensors (name) values ($1) on conflict (name) do nothing", []interface{}{sensor},
+	)
+}
+
+// WriteData stores a whole batch of converted readings in one transaction.
+// Readings, diagnostics and events are told apart by their sensor code. The
+// button presses not stored before are returned.
+func (db *Database) WriteData(macAddress string, data *sensors.Data, device config.Device) ([]*sensors.Reading, error) {
+	tx, err := db.Client.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	deviceId, err := db.getDeviceId(tx, macAddress, device)
+	if err != nil {
+		return nil, err
+	}
+	readings, err := tx.Prepare("insert into readings (device, rawvalue, convertedvalue, timestamp, sensor, code, calibration) values ($1, $2, $3, $4, $5, $6, $7) on conflict (device, code, timestamp) do update set rawvalue = excluded.rawvalue, convertedvalue = excluded.convertedvalue, sensor = excluded.sensor, calibration = excluded.calibration")
+	if err != nil {
+		return nil, err
+	}
+	defer readings.Close()
+
+	diagnostics, err := tx.Prepare("insert into diagnostics (device, code, name, value, timestamp) values ($1, $2, $3, $4, $5) on conflict (device, code, timestamp) do update set name = excluded.name, value = excluded.value")
+	if err != nil {
+		return nil, err
+	}
+	defer diagnostics.Close()
+
+	events, err := tx.Prepare("insert into events (device, type, duration, timestamp) values ($1, $2, $3, $4) on conflict (device, type, timestamp) do nothing")
+	if err != nil {
+		return nil, err
+	}
+	defer events.Close()
+
+	sensorData := sensors.GetSensors()
+	sensorIds := map[string]int64{}
+	calibrationIds := map[time.Time]int64{}
+	newEvents := make([]*sensors.Reading, 0)
+	for _, reading := range data.Readings {
+		kind, name := storage.Classify(sensorData[reading.Code])
+
+		switch kind {
+		case storage.KindEvent:
+			result, err := events.Exec(deviceId, name, reading.ConvertedValue, reading.Timestamp)
+			if err != nil {
+				return nil, err
+			}
+			if inserted, _ := result.RowsAffected(); inserted > 0 {
+				newEvents = append(newEvents, reading)
+			}
+
+		case storage.KindDiagnostic:
+			if _, err := diagnostics.Exec(deviceId, reading.Code, name, reading.ConvertedValue, reading.Timestamp); err != nil {
+				return nil, err
+			}
+
+		default:
+			sensorId, ok := sensorIds[name]
+			if !ok {
+				if sensorId, err = db.getSensorId(tx, name); err != nil {
+					return nil, err
+				}
+				sensorIds[name] = sensorId
+			}
+
+			// the calibration set valid when the reading was taken
+			calibration := device.CalibrationAt(time.Unix(int64(reading.Timestamp), 0))
+			calibrationId, ok := calibrationIds[calibration.EffectiveFrom]
+			if !ok {
+				if calibrationId, err = db.getCalibrationId(tx, deviceId, calibration); err != nil {
+					return nil, err
+				}
+				calibrationIds[calibration.EffectiveFrom] = calibrationId
+			}
+
+			if _, err := readings.Exec(deviceId, reading.RawValue, reading.ConvertedValue, reading.Timestamp, sensorId, reading.Code, calibrationId); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return newEvents, nil
+}
+
+func (db *Database) GetCalibrationId(macAddress string, device config.Device, calibration config.CalibrationSet) (int64, error) {
+	deviceId, err := db.getDeviceId(db.Client, macAddress, device)
+	if err != nil {
+		return 0, err
+	}
+	return db.getCalibrationId(db.Client, deviceId, calibration)
+}
+
+// getCalibrationId returns the id of a calibration set of a device, an unknown
+// set is stored as a new calibration.
+func (db *Database) getCalibrationId(q queryer, deviceId int64, calibration config.CalibrationSet) (int64, error) {
+	encoded, checksum, err := storage.CalibrationChecksum(calibration)
+	if err != nil {
+		return 0, err
+	}
+
+	var effectiveFrom interface{}
+	if !calibration.EffectiveFrom.IsZero() {
+		effectiveFrom = calibration.EffectiveFrom.Unix()
+	}
+
+	return getOrInsertId(q,
+		"select id from calibrations where device = $1 and checksum = $2", []interface{}{deviceId, checksum},
+		"insert into calibrations (device, parameters, checksum, effectivefrom, timestamp) values ($1, $2, $3, $4, $5) on conflict (device, checksum) do nothing", []interface{}{deviceId, encoded, checksum, effectiveFrom, time.Now().Unix()},
+	)
+}
+
+// GetCalibrations returns the calibration sets of a device ordered by the
+// time they became effective.
+func (db *Database) GetCalibrations(deviceId int64) []*storage.Calibration {
+	calibrations := make([]*storage.Calibration, 0)
+	rows, err := db.Client.Query("select id, device, parameters, coalesce(effectivefrom, 0), timestamp from calibrations where device = $1 order by coalesce(effectivefrom, 0), id", deviceId)
+	if err != nil {
+		log.Printf("error: getting calibrations failed: %v", err)
+		return calibrations
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		calibration := new(storage.Calibration)
+		parameters := new(string)
+		err := rows.Scan(&calibration.Id, &calibration.DeviceId, parameters, &calibration.EffectiveFrom, &calibration.Timestamp)
+		if err == sql.ErrNoRows {
+			return calibrations
+		}
+		if err := json.Unmarshal([]byte(*parameters), &calibration.CalibrationParameters); err != nil {
+			log.Printf("error: invalid calibration %d: %v", calibration.Id, err)
+		}
+		calibrations = append(calibrations, calibration)
+	}
+	return calibrations
+}
+
+// GetRawReadings returns the readings of a device within a time range
+// including their sensor code and name, used to recalibrate them.
+func (db *Database) GetRawReadings(deviceId, from, to int64) []*storage.Reading {
+	readings := make([]*storage.Reading, 0)
+	rows, err := db.Client.Query("select r.id, r.device, r.rawvalue, r.convertedvalue, r.timestamp, r.sensor, s.name, coalesce(r.code, 0), coalesce(r.calibration, 0) from readings r join sensors s on s.id = r.sensor where r.device = $1 and r.timestamp >= $2 and r.timestamp <= $3 order by r.timestamp", deviceId, from, to)
+	if err != nil {
+		log.Printf("error: getting raw readings failed: %v", err)
+		return readings
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		reading := new(storage.Reading)
+		err := rows.Scan(&reading.Id, &reading.DeviceId, &reading.RawValue, &reading.ConvertedValue, &reading.Timestamp, &reading.SensorId, &reading.Sensor, &reading.Code, &reading.CalibrationId)
+		if err == sql.ErrNoRows {
+			return readings
+		}
+		readings = append(readings, reading)
+	}
+	return readings
+}
+
+// GetLatestReadings returns the latest reading of every sensor of a device
+// including the sensor name. Of two sensors measuring the same type at the
+// same time the one with the lower code is returned.
+func (db *Database) GetLatestReadings(deviceId int64) []*storage.Reading {
+	readings := make([]*storage.Reading, 0)
+	rows, err := db.Client.Query("select r.id, r.device, r.rawvalue, r.convertedvalue, r.timestamp, r.sensor, s.name, coalesce(r.code, 0), coalesce(r.calibration, 0) from readings r join sensors s on s.id = r.sensor where r.device = $1 and r.timestamp = (select max(timestamp) from readings l where l.device = r.device and l.sensor = r.sensor) order by s.name, coalesce(r.code, 0)", deviceId)
+	if err != nil {
+		log.Printf("error: getting latest readings failed: %v", err)
+		return readings
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		reading := new(storage.Reading)
+		err := rows.Scan(&reading.Id, &reading.DeviceId, &reading.RawValue, &reading.ConvertedValue, &reading.Timestamp, &reading.SensorId, &reading.Sensor, &reading.Code, &reading.CalibrationId)
+		if err == sql.ErrNoRows {
+			return readings
+		}
+		if len(readings) > 0 && readings[len(readings)-1].SensorId == reading.SensorId {
+			continue
+		}
+		readings = append(readings, reading)
+	}
+	return readings
+}
+
+// UpdateConvertedValues stores recalibrated readings in one transaction.
+func (db *Database) UpdateConvertedValues(readings []*storage.Reading) error {
+	tx, err := db.Client.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	statement, err := tx.Prepare("update readings set convertedvalue = $1, code = $2, calibration = $3 where id = $4")
+	if err != nil {
+		return err
+	}
+	defer statement.Close()
+
+	for _, reading := range readings {
+		if _, err := statement.Exec(reading.ConvertedValue, reading.Code, reading.CalibrationId, reading.Id); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (db *Database) GetDiagnostics(deviceId int64, days int) []*storage.Diagnostic {
+	timestamp := time.Now().AddDate(0, 0, -days)
+	diagnostics := make([]*storage.Diagnostic, 0)
+	rows, err := db.Client.Query("select id, device, code, name, value, timestamp from diagnostics where timestamp > $1 and device = $2 order by timestamp, code", timestamp.Unix(), deviceId)
+	if err != nil {
+		log.Printf("error: getting diagnostics failed: %v", err)
+		return diagnostics
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		diagnostic := new(storage.Diagnostic)
+		err := rows.Scan(&diagnostic.Id, &diagnostic.DeviceId, &diagnostic.Code, &diagnostic.Name, &diagnostic.Value, &diagnostic.Timestamp)
+		if err == sql.ErrNoRows {
+			return diagnostics
+		}
+		diagnostics = append(diagnostics, diagnostic)
+	}
+	return diagnostics
+}
+
+// WriteEvent stores an event and reports whether it is new, a retransmitted
+// event is not stored again.
+func (db *Database) WriteEvent(macAddress, eventType string, duration float64, timestamp int64, device config.Device) bool {
+	deviceId := db.GetDeviceId(macAddress, device)
+
+	result, err := db.Client.Exec("insert into events (device, type, duration, timestamp) values ($1, $2, $3, $4) on conflict (device, type, timestamp) do nothing", deviceId, eventType, duration, timestamp)
+	if err != nil {
+		log.Printf("error: writing event of device %s failed: %v", macAddress, err)
+		return false
+	}
+	inserted, _ := result.RowsAffected()
+	return inserted > 0
+}
+
+func (db *Database) GetEvents(deviceId int64, days int) []*storage.Event {
+	timestamp := time.Now().AddDate(0, 0, -days)
+	events := make([]*storage.Event, 0)
+	rows, err := db.Client.Query("select id, device, type, duration, timestamp from events where timestamp > $1 and device = $2 order by timestamp, id", timestamp.Unix(), deviceId)
+	if err != nil {
+		log.Printf("error: getting events failed: %v", err)
+		return events
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		event := new(storage.Event)
+		err := rows.Scan(&event.Id, &event.DeviceId, &event.Type, &event.Duration, &event.Timestamp)
+		if err == sql.ErrNoRows {
+			return events
+		}
+		events = append(events, event)
+	}
+	return events
+}
+
+// GetLatestEvent returns the latest event of a type, nil if there is none.
+func (db *Database) GetLatestEvent(deviceId int64, eventType string) *storage.Event {
+	row := db.Client.QueryRow("select id, device, type, duration, timestamp from events where device = $1 and type = $2 order by timestamp desc, id desc limit 1", deviceId, eventType)
+	event := new(storage.Event)
+	if err := row.Scan(&event.Id, &event.DeviceId, &event.Type, &event.Duration, &event.Timestamp); err != nil {
+		return nil
+	}
+	return event
+}
+
+// GetReadings returns the readings of a sensor within a time range, averaged
+// per step if the query has one.
+func (db *Database) GetReadings(deviceId, sensorId int64, query storage.ReadingQuery) []*storage.Reading {
+	timestamp, columns, group := "timestamp", "rawvalue, convertedvalue, coalesce(calibration, 0)", ""
+	if query.Step > 0 {
+		timestamp = fmt.Sprintf("timestamp / %d * %d", query.Step, query.Step)
+		columns = "avg(rawvalue), avg(convertedvalue), max(coalesce(calibration, 0))"
+		group = " group by " + timestamp
+	}
+	order := " order by 1"
+	if query.Descending {
+		order += " desc"
+	}
+	limit := ""
+	if query.Limit > 0 {
+		limit = fmt.Sprintf(" limit %d", query.Limit)
+	}
+
+	readings := make([]*storage.Reading, 0)
+	rows, err := db.Client.Query("select "+timestamp+", "+columns+" from readings where device = $1 and sensor = $2 and timestamp >= $3 and timestamp <= $4"+group+order+limit, deviceId, sensorId, query.From, query.To)
+	if err != nil {
+		log.Printf("error: getting readings failed: %v", err)
+		return readings
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		reading := &storage.Reading{DeviceId: deviceId, SensorId: sensorId}
+		err := rows.Scan(&reading.Timestamp, &reading.RawValue, &reading.ConvertedValue, &reading.CalibrationId)
+		if err == sql.ErrNoRows {
+			return readings
+		}
+		readings = append(readings, reading)
+	}
+	return readings
+}
+
+// GetAggregates returns the statistics of a sensor per time bucket. The
+// percentiles use the nearest rank, the smallest value with at least the
+// given fraction of the bucket at or below it.
+func (db *Database) GetAggregates(deviceId, sensorId int64, query storage.AggregateQuery) ([]*storage.Aggregate, error) {
+	bucket := fmt.Sprintf("(timestamp - %d) / %d * %d + %d", query.Offset, query.Bucket, query.Bucket, query.Offset)
+	columns := "bucket, count(*), avg(value), min(value), max(value)"
+	for _, p := range query.Percentiles {
+		columns += fmt.Sprintf(", min(case when rownum >= %g * total then value end)", p)
+	}
+
+	rows, err := db.Client.Query("with b as (select "+bucket+" as bucket, convertedvalue as value, row_number() over (partition by "+bucket+" order by convertedvalue) as rownum, count(*) over (partition by "+bucket+") as total from readings where device = $1 and sensor = $2 and timestamp >= $3 and timestamp <= $4) select "+columns+" from b group by bucket order by bucket", deviceId, sensorId, query.From, query.To)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	aggregates := make([]*storage.Aggregate, 0)
+	for rows.Next() {
+		aggregate := &storage.Aggregate{Percentiles: make([]float64, len(query.Percentiles))}
+		values := []interface{}{&aggregate.Timestamp, &aggregate.Count, &aggregate.Avg, &aggregate.Min, &aggregate.Max}
+		for i := range aggregate.Percentiles {
+			values = append(values, &aggregate.Percentiles[i])
+		}
+		if err := rows.Scan(values...); err != nil {
+			return nil, err
+		}
+		aggregates = append(aggregates, aggregate)
+	}
+	return aggregates, rows.Err()
+}
+
+const deviceColumns = "id, macaddress, coalesce(name, ''), coalesce(notes, ''), coalesce(location, ''), coalesce(lastseen, 0), coalesce(deleted, 0)"
+
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanDevice(row scanner) (*storage.Device, error) {
+	device := new(storage.Device)
+	err := row.Scan(&device.Id, &device.MacAddress, &device.Name, &device.Notes, &device.Location, &device.LastSeen, &device.Deleted)
+	return device, err
+}
+
+// GetDevice returns a stored device, nil if there is none with the mac
+// address. Unlike GetDeviceId it never creates the device.
+func (db *Database) GetDevice(macAddress string) *storage.Device {
+	device, err := scanDevice(db.Client.QueryRow("select "+deviceColumns+" from devices where macaddress = $1", macAddress))
+	if err != nil {
+		return nil
+	}
+	return device
+}
+
+// GetDevices returns all stored devices, deleted ones included.
+func (db *Database) GetDevices() []*storage.Device {
+	devices := make([]*storage.Device, 0)
+	rows, err := db.Client.Query("select " + deviceColumns + " from devices order by id")
+	if err != nil {
+		log.Printf("error: getting devices failed: %v", err)
+		return devices
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		device, err := scanDevice(rows)
+		if err == sql.ErrNoRows {
+			return devices
+		}
+		devices = append(devices, device)
+	}
+	return devices
+}
+
+// UpdateDevice stores the name, notes, location and deletion time of a device.
+func (db *Database) UpdateDevice(device *storage.Device) error {
+	_, err := db.Client.Exec("update devices set name = $1, notes = $2, location = $3, deleted = $4 where id = $5", device.Name, device.Notes, device.Location, nullIfZero(device.Deleted), device.Id)
+	return err
+}
+
+// nullIfZero stores times not set as null.
+func nullIfZero(timestamp int64) interface{} {
+	if timestamp == 0 {
+		return nil
+	}
+	return timestamp
+}
+
+// MergeDevices moves the whole history of the source device to the target
+// device and removes the source. Where both devices have a reading, diagnostic
+// or event of the same time the one of the target is kept. The target keeps
+// its name, notes and location unless they are empty.
+func (db *Database) MergeDevices(sourceId, targetId int64) error {
+	tx, err := db.Client.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// sqlite numbers $n parameters in the order they appear, so $1 has to
+	// come first in every statement
+	source, sourceTarget, targetSource := []interface{}{sourceId}, []interface{}{sourceId, targetId}, []interface{}{targetId, sourceId}
+	statements := []struct {
+		query string
+		args  []interface{}
+	}{
+		// readings of calibrations both devices have refer to the one of the target
+		{"update readings set calibration = (select t.id from calibrations t join calibrations s on s.checksum = t.checksum where s.id = readings.calibration and t.device = $1) where device = $2 and calibration in (select s.id from calibrations s join calibrations t on t.checksum = s.checksum where s.device = $2 and t.device = $1)", targetSource},
+		{"delete from calibrations where device = $1 and checksum in (select checksum from calibrations where device = $2)", sourceTarget},
+		{"update calibrations set device = $1 where device = $2", targetSource},
+
+		{"update readings set device = $1 where device = $2 and not exists (select 1 from readings r where r.device = $1 and r.code = readings.code and r.timestamp = readings.timestamp)", targetSource},
+		{"delete from readings where device = $1", source},
+		{"update diagnostics set device = $1 where device = $2 and not exists (select 1 from diagnostics d where d.device = $1 and d.code = diagnostics.code and d.timestamp = diagnostics.timestamp)", targetSource},
+		{"delete from diagnostics where device = $1", source},
+		{"update events set device = $1 where device = $2 and not exists (select 1 from events e where e.device = $1 and e.type = events.type and e.timestamp = events.timestamp)", targetSource},
+		{"delete from events where device = $1", source},
+		{"update device_info set device = $1 where device = $2", targetSource},
+		{"update alerts set device = $1 where device = $2", targetSource},
+		{"delete from device_configs where device = $1", source},
+
+		{"update devices set name = coalesce(nullif(devices.name, ''), s.name), notes = coalesce(nullif(devices.notes, ''), s.notes), location = coalesce(nullif(devices.location, ''), s.location), lastseen = case when coalesce(s.lastseen, 0) > coalesce(devices.lastseen, 0) then s.lastseen else devices.lastseen end from (select name, notes, location, lastseen from devices where id = $1) s where devices.id = $2", sourceTarget},
+		{"delete from devices where id = $1", source},
+	}
+	for _, statement := range statements {
+		if _, err := tx.Exec(statement.query, statement.args...); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// SetLastSeen records the time of an authenticated request of a device.
+func (db *Database) SetLastSeen(macAddress string, device config.Device, timestamp int64) {
+	deviceId := db.GetDeviceId(macAddress, device)
+
+	if _, err := db.Client.Exec("update devices set lastseen = $1 where id = $2", timestamp, deviceId); err != nil {
+		log.Printf("error: setting last seen failed: %v", err)
+	}
+}
+
+// WriteDeviceInfo stores a device announcement, unchanged announcements are
+// skipped so the table only holds the history of changes.
+func (db *Database) WriteDeviceInfo(macAddress string, info *sensors.DeviceInfo, raw string, device config.Device) {
+	deviceId := db.GetDeviceId(macAddress, device)
+
+	row := db.Client.QueryRow("select raw from device_info where device = $1 order by timestamp desc, id desc limit 1", deviceId)
+	latest := new(string)
+	if err := row.Scan(latest); err == nil && *latest == raw {
+		return
+	}
+
+	if _, err := db.Client.Exec("insert into device_info (device, firmwareversion, hardwareproducttype, raw, timestamp) values ($1, $2, $3, $4, $5)", deviceId, info.FirmwareVersion, info.HardwareProductType, raw, time.Now().Unix()); err != nil {
+		log.Printf("error: writing device info failed: %v", err)
+	}
+}
+
+func (db *Database) GetDeviceInfo(deviceId int64) []*storage.DeviceInfo {
+	infos := make([]*storage.DeviceInfo, 0)
+	rows, err := db.Client.Query("select id, device, firmwareversion, hardwareproducttype, raw, timestamp from device_info where device = $1 order by timestamp desc, id desc", deviceId)
+	if err != nil {
+		log.Printf("error: getting device info failed: %v", err)
+		return infos
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		info := new(storage.DeviceInfo)
+		err := rows.Scan(&info.Id, &info.DeviceId, &info.FirmwareVersion, &info.HardwareProductType, &info.Raw, &info.Timestamp)
+		if err == sql.ErrNoRows {
+			return infos
+		}
+		infos = append(infos, info)
+	}
+	return infos
+}
+
+const alertColumns = "a.id, a.rule, a.device, d.macaddress, a.sensor, a.state, a.value, a.threshold, a.started, a.updated, coalesce(a.triggered, 0), coalesce(a.acknowledged, 0), coalesce(a.resolved, 0)"
+
+func scanAlert(row scanner) (*storage.Alert, error) {
+	alert := new(storage.Alert)
+	err := row.Scan(&alert.Id, &alert.Rule, &alert.DeviceId, &alert.MacAddress, &alert.Sensor, &alert.State, &alert.Value, &alert.Threshold, &alert.Started, &alert.Updated, &alert.Triggered, &alert.Acknowledged, &alert.Resolved)
+	return alert, err
+}
+
+// WriteAlert stores a new alert or the changes of a stored one.
+func (db *Database) WriteAlert(alert *storage.Alert) error {
+	if alert.Id == 0 {
+		id, err := db.insert(db.Client, "insert into alerts (rule, device, sensor, state, value, threshold, started, updated, triggered, acknowledged, resolved) values ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)", alert.Rule, alert.DeviceId, alert.Sensor, alert.State, alert.Value, alert.Threshold, alert.Started, alert.Updated, nullIfZero(alert.Triggered), nullIfZero(alert.Acknowledged), nullIfZero(alert.Resolved))
+		alert.Id = id
+		return err
+	}
+
+	_, err := db.Client.Exec("update alerts set state = $1, value = $2, threshold = $3, updated = $4, triggered = $5, acknowledged = $6, resolved = $7 where id = $8", alert.State, alert.Value, alert.Threshold, alert.Updated, nullIfZero(alert.Triggered), nullIfZero(alert.Acknowledged), nullIfZero(alert.Resolved), alert.Id)
+	return err
+}
+
+func (db *Database) DeleteAlert(id int64) {
+	if _, err := db.Client.Exec("delete from alerts where id = $1", id); err != nil {
+		log.Printf("error: deleting alert failed: %v", err)
+	}
+}
+
+// GetAlert returns an alert, nil if there is none with the id.
+func (db *Database) GetAlert(id int64) *storage.Alert {
+	alert, err := scanAlert(db.Client.QueryRow("select "+alertColumns+" from alerts a join devices d on d.id = a.device where a.id = $1", id))
+	if err != nil {
+		return nil
+	}
+	return alert
+}
+
+// GetAlerts returns the alerts of all devices or, if deviceId is not 0, of a
+// single one, newest first. Active alerts are those not resolved.
+func (db *Database) GetAlerts(deviceId int64, active bool) []*storage.Alert {
+	alerts := make([]*storage.Alert, 0)
+	rows, err := db.Client.Query("select "+alertColumns+" from alerts a join devices d on d.id = a.device where ($1 = 0 or a.device = $1) and ($2 = false or a.state <> $3) order by a.started desc, a.id desc", deviceId, active, model.AlertResolved)
+	if err != nil {
+		log.Printf("error: getting alerts failed: %v", err)
+		return alerts
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		alert, err := scanAlert(rows)
+		if err == sql.ErrNoRows {
+			return alerts
+		}
+		alerts = append(alerts, alert)
+	}
+	return alerts
+}
+
+// GetLatestAlert returns the latest alert of a rule for a device, nil if there
+// is none.
+func (db *Database) GetLatestAlert(deviceId int64, rule string) *storage.Alert {
+	alert, err := scanAlert(db.Client.QueryRow("select "+alertColumns+" from alerts a join devices d on d.id = a.device where a.device = $1 and a.rule = $2 order by a.started desc, a.id desc limit 1", deviceId, rule))
+	if err != nil {
+		return nil
+	}
+	return alert
+}
+
+// WritePayload archives the raw payload of a device request, plaintext is nil
+// if the payload could not be decrypted.
+func (db *Database) WritePayload(macAddress, endpoint string, ciphertext, plaintext []byte) {
+	if _, err := db.Client.Exec("insert into payloads (macaddress, endpoint, ciphertext, plaintext, timestamp) values ($1, $2, $3, $4, $5)", macAddress, endpoint, ciphertext, plaintext, time.Now().Unix()); err != nil {
+		log.Printf("error: writing payload failed: %v", err)
+	}
+}
+
+// GetPayloads returns the archived payloads of an endpoint for all devices or,
+// if macAddress is not empty, of a single one, oldest first.
+func (db *Database) GetPayloads(macAddress, endpoint string) []*storage.Payload {
+	payloads := make([]*storage.Payload, 0)
+	rows, err := db.Client.Query("select id, macaddress, endpoint, ciphertext, plaintext, timestamp from payloads where ($1 = '' or macaddress = $1) and endpoint = $2 order by timestamp, id", macAddress, endpoint)
+	if err != nil {
+		log.Printf("error: getting payloads failed: %v", err)
+		return payloads
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		payload := new(storage.Payload)
+		err := rows.Scan(&payload.Id, &payload.MacAddress, &payload.Endpoint, &payload.Ciphertext, &payload.Plaintext, &payload.Timestamp)
+		if err == sql.ErrNoRows {
+			return payloads
+		}
+		payloads = append(payloads, payload)
+	}
+	return payloads
+}
+
+// WriteRelayEntry queues a decrypted readings payload for an upstream server.
+func (db *Database) WriteRelayEntry(macAddress, url string, payload []byte) {
+	now := time.Now().Unix()
+	if _, err := db.Client.Exec("insert into relay_queue (macaddress, url, payload, nextattempt, timestamp) values ($1, $2, $3, $4, $5)", macAddress, url, payload, now, now); err != nil {
+		log.Printf("error: writing relay entry failed: %v", err)
+	}
+}
+
+// GetDueRelayEntries returns the queued payloads due to be forwarded, oldest
+// first.
+func (db *Database) GetDueRelayEntries(now int64) []*storage.RelayEntry {
+	entries := make([]*storage.RelayEntry, 0)
+	rows, err := db.Client.Query("select id, macaddress, url, payload, attempts, nextattempt, coalesce(lasterror, ''), timestamp from relay_queue where nextattempt <= $1 order by timestamp, id", now)
+	if err != nil {
+		log.Printf("error: getting due relay entries failed: %v", err)
+		return entries
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		entry := new(storage.RelayEntry)
+		err := rows.Scan(&entry.Id, &entry.MacAddress, &entry.URL, &entry.Payload, &entry.Attempts, &entry.NextAttempt, &entry.LastError, &entry.Timestamp)
+		if err == sql.ErrNoRows {
+			return entries
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+// RetryRelayEntry records a failed forward and when to try again.
+func (db *Database) RetryRelayEntry(id, nextAttempt int64, lastError string) {
+	if _, err := db.Client.Exec("update relay_queue set attempts = attempts + 1, nextattempt = $1, lasterror = $2 where id = $3", nextAttempt, lastError, id); err != nil {
+		log.Printf("error: retrying relay entry failed: %v", err)
+	}
+}
+
+func (db *Database) DeleteRelayEntry(id int64) {
+	if _, err := db.Client.Exec("delete from relay_queue where id = $1", id); err != nil {
+		log.Printf("error: deleting relay entry failed: %v", err)
+	}
+}
+
+// GetRelayQueue returns the number of queued payloads per device and upstream.
+func (db *Database) GetRelayQueue() []*storage.RelayQueue {
+	queues := make([]*storage.RelayQueue, 0)
+	rows, err := db.Client.Query("select q.macaddress, q.url, count(*), min(q.timestamp), max(q.attempts), coalesce((select l.lasterror from relay_queue l where l.macaddress = q.macaddress and l.url = q.url order by l.attempts desc, l.id limit 1), '') from relay_queue q group by q.macaddress, q.url order by q.macaddress, q.url")
+	if err != nil {
+		log.Printf("error: getting relay queue failed: %v", err)
+		return queues
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		queue := new(storage.RelayQueue)
+		err := rows.Scan(&queue.MacAddress, &queue.URL, &queue.Payloads, &queue.Oldest, &queue.Attempts, &queue.LastError)
+		if err == sql.ErrNoRows {
+			return queues
+		}
+		queues = append(queues, queue)
+	}
+	return queues
+}
+
+// WritePendingPayload keeps the encrypted payload of an unknown device until
+// its key is known. Only the newest limit payloads of a device are kept.
+func (db *Database) WritePendingPayload(macAddress, endpoint string, payload []byte, limit int) {
+	if _, err := db.Client.Exec("insert into pending_payloads (macaddress, endpoint, payload, timestamp) values ($1, $2, $3, $4)", macAddress, endpoint, payload, time.Now().Unix()); err != nil {
+		log.Printf("error: writing pending payload failed: %v", err)
+	}
+
+	result, err := db.Client.Exec("delete from pending_payloads where macaddress = $1 and id not in (select id from pending_payloads where macaddress = $1 order by id desc limit $2)", macAddress, limit)
+	if err != nil {
+		log.Printf("error: limiting pending payloads of %s failed: %v", macAddress, err)
+	} else if dropped, _ := result.RowsAffected(); dropped > 0 {
+		log.Printf("warning: dropped %d oldest pending payloads of %s", dropped, macAddress)
+	}
+}
+
+// GetPendingPayloads returns the buffered payloads of all unknown devices or,
+// if macAddress is not empty, of a single one, oldest first.
+func (db *Database) GetPendingPayloads(macAddress string) []*storage.PendingPayload {
+	payloads := make([]*storage.PendingPayload, 0)
+	rows, err := db.Client.Query("select id, macaddress, endpoint, payload, timestamp from pending_payloads where $1 = '' or macaddress = $1 order by timestamp, id", macAddress)
+	if err != nil {
+		log.Printf("error: getting pending payloads failed: %v", err)
+		return payloads
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		payload := new(storage.PendingPayload)
+		err := rows.Scan(&payload.Id, &payload.MacAddress, &payload.Endpoint, &payload.Payload, &payload.Timestamp)
+		if err == sql.ErrNoRows {
+			return payloads
+		}
+		payloads = append(payloads, payload)
+	}
+	return payloads
+}
+
+func (db *Database) DeletePendingPayloads(macAddress string) {
+	if _, err := db.Client.Exec("delete from pending_payloads where macaddress = $1", macAddress); err != nil {
+		log.Printf("error: deleting pending payloads failed: %v", err)
+	}
+}
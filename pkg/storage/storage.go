@@ -0,0 +1,269 @@
+package storage
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+
+	"koubachi-goserver/pkg/config"
+	"koubachi-goserver/pkg/model"
+	"koubachi-goserver/pkg/sensors"
+)
+
+// names of the storage backends selectable in config.Output
+const SQLite = "sqlite"
+const Postgres = "postgres"
+const Memory = "memory"
+
+// Store persists devices, sensors, readings and everything derived from them.
+// Times are unix timestamps, ids are only valid within the same store.
+type Store interface {
+	// devices
+	GetDeviceId(macAddress string, device config.Device) int64
+	GetDevice(macAddress string) *Device
+	GetDevices() []*Device
+	UpdateDevice(device *Device) error
+	MergeDevices(sourceId, targetId int64) error
+	SetLastSeen(macAddress string, device config.Device, timestamp int64)
+	UpdateConfigChecksum(macAddress string, device config.Device, checksum string) int64
+	WriteDeviceInfo(macAddress string, info *sensors.DeviceInfo, raw string, device config.Device)
+	GetDeviceInfo(deviceId int64) []*DeviceInfo
+
+	// sensors and readings
+	GetSensorId(sensor string) int64
+	WriteData(macAddress string, data *sensors.Data, device config.Device) ([]*sensors.Reading, error)
+	GetReadings(deviceId, sensorId int64, query ReadingQuery) []*Reading
+	GetAggregates(deviceId, sensorId int64, query AggregateQuery) ([]*Aggregate, error)
+	GetRawReadings(deviceId, from, to int64) []*Reading
+	GetLatestReadings(deviceId int64) []*Reading
+	UpdateConvertedValues(readings []*Reading) error
+
+	// calibrations
+	GetCalibrationId(macAddress string, device config.Device, calibration config.CalibrationSet) (int64, error)
+	GetCalibrations(deviceId int64) []*Calibration
+
+	// diagnostics and events
+	GetDiagnostics(deviceId int64, days int) []*Diagnostic
+	WriteEvent(macAddress, eventType string, duration float64, timestamp int64, device config.Device) bool
+	GetEvents(deviceId int64, days int) []*Event
+	GetLatestEvent(deviceId int64, eventType string) *Event
+
+	// alerts
+	WriteAlert(alert *Alert) error
+	DeleteAlert(id int64)
+	GetAlert(id int64) *Alert
+	GetAlerts(deviceId int64, active bool) []*Alert
+	GetLatestAlert(deviceId int64, rule string) *Alert
+
+	// raw payloads
+	WritePayload(macAddress, endpoint string, ciphertext, plaintext []byte)
+	GetPayloads(macAddress, endpoint string) []*Payload
+	// keeps at most limit payloads per mac address, dropping the oldest
+	WritePendingPayload(macAddress, endpoint string, payload []byte, limit int)
+	GetPendingPayloads(macAddress string) []*PendingPayload
+	DeletePendingPayloads(macAddress string)
+
+	// relay queue
+	WriteRelayEntry(macAddress, url string, payload []byte)
+	GetDueRelayEntries(now int64) []*RelayEntry
+	RetryRelayEntry(id, nextAttempt int64, lastError string)
+	DeleteRelayEntry(id int64)
+	GetRelayQueue() []*RelayQueue
+
+	Close() error
+}
+
+type Device struct {
+	Id         int64
+	MacAddress string
+	Name       string
+	Notes      string
+	Location   string
+	// LastSeen is the time of the last authenticated request, 0 if never
+	LastSeen int64
+	// Deleted is the time the device was deleted, 0 if it was not
+	Deleted int64
+}
+
+type Sensor struct {
+	Id   int64
+	Name string
+}
+
+type DeviceInfo struct {
+	Id                  int64
+	DeviceId            int64
+	FirmwareVersion     string
+	HardwareProductType string
+	Raw                 string
+	Timestamp           int64
+}
+
+type Diagnostic struct {
+	Id        int64
+	DeviceId  int64
+	Code      int
+	Name      string
+	Value     float64
+	Timestamp int64
+}
+
+type Event struct {
+	Id        int64
+	DeviceId  int64
+	Type      string
+	Duration  float64
+	Timestamp int64
+}
+
+// Alert is raised by a rule for a device, times of states not reached are 0.
+type Alert struct {
+	Id       int64
+	Rule     string
+	DeviceId int64
+	// MacAddress is the one of the device, it is not written
+	MacAddress string
+	Sensor     string
+	State      string
+	// Value is the last value evaluated at Updated
+	Value        float64
+	Threshold    float64
+	Started      int64
+	Updated      int64
+	Triggered    int64
+	Acknowledged int64
+	Resolved     int64
+}
+
+type Payload struct {
+	Id         int64
+	MacAddress string
+	Endpoint   string
+	Ciphertext []byte
+	Plaintext  []byte
+	Timestamp  int64
+}
+
+type RelayEntry struct {
+	Id          int64
+	MacAddress  string
+	URL         string
+	Payload     []byte
+	Attempts    int
+	NextAttempt int64
+	LastError   string
+	Timestamp   int64
+}
+
+// RelayQueue is the depth of the relay queue of a device and upstream.
+type RelayQueue struct {
+	MacAddress string
+	URL        string
+	Payloads   int
+	Oldest     int64
+	// most failed attempts of a payload and the error of its last attempt
+	Attempts  int
+	LastError string
+}
+
+type PendingPayload struct {
+	Id         int64
+	MacAddress string
+	Endpoint   string
+	Payload    []byte
+	Timestamp  int64
+}
+
+type Reading struct {
+	Id             int64
+	DeviceId       int64
+	RawValue       float64
+	ConvertedValue float64
+	Timestamp      int64
+	SensorId       int64
+	Sensor         string
+	Code           int
+	CalibrationId  int64
+}
+
+// ReadingQuery selects the readings of a sensor. From and To are inclusive
+// unix timestamps and a Limit of 0 returns all readings. With a Step the
+// readings are averaged into buckets of that many seconds, timestamped with
+// the start of the bucket.
+type ReadingQuery struct {
+	From       int64
+	To         int64
+	Limit      int
+	Descending bool
+	Step       int64
+}
+
+// AggregateQuery selects the statistics of a sensor per time bucket. Buckets
+// are Bucket seconds long and start at Offset seconds after the epoch, the
+// percentiles are fractions between 0 and 1.
+type AggregateQuery struct {
+	From        int64
+	To          int64
+	Bucket      int64
+	Offset      int64
+	Percentiles []float64
+}
+
+// Aggregate holds the statistics of the converted values within a bucket,
+// percentiles in the order of the query.
+type Aggregate struct {
+	Timestamp   int64
+	Count       int
+	Avg         float64
+	Min         float64
+	Max         float64
+	Percentiles []float64
+}
+
+type Calibration struct {
+	Id                    int64
+	DeviceId              int64
+	CalibrationParameters config.CalibrationParameters
+	EffectiveFrom         int64
+	Timestamp             int64
+}
+
+// Kinds of data a sensor code is stored as.
+const (
+	KindReading = iota
+	KindDiagnostic
+	KindEvent
+)
+
+// Classify returns how the value of a sensor code is stored and under which
+// name. Statistics, errors and unknown codes are kept apart from the readings
+// as diagnostics, button presses are events.
+func Classify(mapper sensors.Sensors) (int, string) {
+	switch {
+	case mapper.Event:
+		return KindEvent, mapper.Type
+	case mapper.Diagnostic:
+		return KindDiagnostic, mapper.Type
+	case mapper.Type == "":
+		return KindDiagnostic, model.Unknown
+	}
+	return KindReading, mapper.Type
+}
+
+// CalibrationChecksum identifies a calibration set of a device. It returns the
+// encoded parameters and the checksum, the same parameters can be valid in
+// more than one period.
+func CalibrationChecksum(calibration config.CalibrationSet) (string, string, error) {
+	encoded, err := json.Marshal(calibration.CalibrationParameters)
+	if err != nil {
+		return "", "", err
+	}
+
+	checksumData := encoded
+	if !calibration.EffectiveFrom.IsZero() {
+		checksumData = append(checksumData, []byte(fmt.Sprintf("@%d", calibration.EffectiveFrom.Unix()))...)
+	}
+	sum := sha256.Sum256(checksumData)
+	return string(encoded), hex.EncodeToString(sum[:]), nil
+}